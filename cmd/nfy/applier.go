@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+
+	"cdr.dev/nfy/internal/clog"
+	"cdr.dev/nfy/internal/facts"
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/packages"
+	"cdr.dev/nfy/internal/report"
+	"cdr.dev/nfy/internal/runner"
+)
+
+// applier installs a graph on the system its executor runs scripts on, recording the result of each target.
+type applier struct {
+	ctx context.Context
+	ex  runner.Executor
+	log *clog.Logger
+	// output returns where the script output of the nth installer is written, given its padded name.
+	output func(n int, name string) runner.Output
+	// logs is optional.
+	logs       *runner.LogDir
+	results    *report.Recorder
+	showOutput bool
+	checkOnly  bool
+	// vars are rendered into scripts along with the system's facts.
+	vars map[string]string
+
+	total     int
+	installed int
+
+	// grp is the graph being applied.
+	grp graph.RecipeIndex
+	// plan is how grp would be installed if every install succeeded, for finding the packages to install together.
+	// It's planned when the first packages recipe is installed.
+	plan []graph.Step
+	// done has the result of each target so far, including those installed along with another.
+	done map[string]error
+	// roots are the full names of the requested targets, leaving out the requirements other targets probe for.
+	// Other requirements only rule out the installers needing them.
+	roots map[string]bool
+}
+
+// apply traverses grp, installing each target that doesn't pass its check.
+// Recipes and installers whose when conditions don't match the system's facts are left out.
+func (p *applier) apply(grp graph.RecipeIndex) error {
+	f, err := facts.Gather(p.ctx, p.ex)
+	if err != nil {
+		return err
+	}
+	p.log.Debug("facts of %v: %+v", p.ex, f)
+	p.grp = grp.When(f.Match).Render(graph.TemplateData{Facts: &f, Vars: p.vars})
+	p.plan = nil
+	p.done = make(map[string]error)
+	p.roots = make(map[string]bool)
+	probes := p.grp.Probes()
+	for _, r := range p.grp {
+		if len(r.Installers) > 0 && !probes[r.Installers[0].Runner.FullName()] {
+			p.roots[r.Installers[0].Runner.FullName()] = true
+		}
+	}
+	fn := func(installer runner.Installer) error {
+		if err, ok := p.done[installer.FullName()]; ok {
+			return err
+		}
+		err := p.install(installer)
+		p.done[installer.FullName()] = err
+		return err
+	}
+	if !p.checkOnly {
+		return p.grp.Traverse(p.ctx, fn)
+	}
+
+	// Checks are an audit, so every target is checked even once one is found missing.
+	var errs []string
+	for _, name := range p.grp.Names() {
+		err := p.grp[name].Traverse(p.ctx, name, fn)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// run executes a phase of the installer, logging its output if requested.
+func (p *applier) run(installer runner.Installer, phase string, out runner.Output, fn func(runner.Output) error) error {
+	if p.logs == nil {
+		return fn(out)
+	}
+	log, err := p.logs.Open(installer, phase)
+	if err != nil {
+		return err
+	}
+	err = fn(out.Tee(log))
+	log.Close(err)
+	return err
+}
+
+func (p *applier) record(installer runner.Installer, start time.Time, status report.Status, msg string, output *bytes.Buffer) {
+	p.results.Add(report.Case{
+		Target:    installer.FullName(),
+		Installer: installer.Name,
+		Status:    status,
+		Message:   msg,
+		Output:    output.String(),
+		Duration:  time.Since(start),
+	})
+}
+
+func (p *applier) install(installer runner.Installer) error {
+	p.total++
+	var captured bytes.Buffer
+	start := time.Now()
+	switch {
+	case installer.Skip != "":
+		p.record(installer, start, report.Skipped, installer.Skip, &captured)
+		return nil
+	case installer.DependencyOnly():
+		p.record(installer, start, report.Skipped, "only proxies dependencies", &captured)
+		return nil
+	case installer.Recipe.BuildOnly:
+		p.record(installer, start, report.Skipped, "build_only", &captured)
+		return nil
+	}
+
+	if installer.Manager != "" && !p.checkOnly {
+		return p.installPackages(installer)
+	}
+
+	name := fmt.Sprintf("%-16s", installer.FQDN(installer.Recipe))
+	prefix := color.New(color.Bold).Sprint(name)
+	out := p.output(p.total, name)
+
+	if installer.Recipe.Check != "" {
+		// Check output is noisy, so it's only shown when asked for.
+		checkOut := runner.Output{Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+		if p.showOutput {
+			checkOut = out
+		}
+		err := p.run(installer, "check", checkOut.Tee(&captured), func(out runner.Output) error {
+			return installer.Check(p.ctx, p.ex, out)
+		})
+		out.Flush()
+		if err == nil {
+			p.log.Info("%s\tcheck succeeded (%v)", prefix, time.Since(start))
+			p.record(installer, start, report.Passed, "", &captured)
+			return nil
+		}
+		if installer.CheckOnly() {
+			// The requirement is missing, so installers depending on it can't be used.
+			// That's only a failure if it was requested, rather than probed by an overloaded target.
+			if p.roots[installer.FullName()] {
+				p.log.Error("%s\tcheck failed: %v (%v)", prefix, err, time.Since(start))
+				p.record(installer, start, report.Failed, "check failed: "+err.Error(), &captured)
+			} else {
+				p.log.Info("%s\trequirement not met: %v (%v)", prefix, err, time.Since(start))
+				p.record(installer, start, report.Skipped, "requirement not met: "+err.Error(), &captured)
+			}
+			return fmt.Errorf("%s\tcheck failed: %v", prefix, err)
+		}
+		if p.checkOnly {
+			p.log.Error("%s\tcheck failed: %v (%v)", prefix, err, time.Since(start))
+			p.record(installer, start, report.Failed, "check failed: "+err.Error(), &captured)
+			return nil
+		}
+	} else if p.checkOnly {
+		p.record(installer, start, report.Skipped, "no check", &captured)
+		return nil
+	}
+
+	err := p.run(installer, "install", out.Tee(&captured), func(out runner.Output) error {
+		return installer.Install(p.ctx, p.ex, out)
+	})
+	out.Flush()
+	if err != nil {
+		p.record(installer, start, report.Failed, "install failed: "+err.Error(), &captured)
+		return fmt.Errorf("%s\tinstall failed: %v (%v)", prefix, err, time.Since(start))
+	}
+	var noCheckMessage string
+	if installer.Recipe.Check == "" {
+		noCheckMessage = "no check, "
+	}
+	p.log.Success("%s\t%sinstalled (%v)", prefix, noCheckMessage, time.Since(start))
+	p.record(installer, start, report.Passed, "installed", &captured)
+
+	p.installed++
+	return nil
+}
+
+// batch returns installer along with the other planned installers that use the same package manager
+// and whose dependencies have all been installed, so that their packages can be installed together.
+func (p *applier) batch(installer runner.Installer) []runner.Installer {
+	if p.plan == nil {
+		// Without a plan, each recipe installs its own packages. Traversal reports why planning failed.
+		p.plan, _ = p.grp.Plan(p.ctx, func(runner.Installer) error { return nil })
+	}
+
+	batch := []runner.Installer{installer}
+	for _, step := range p.plan {
+		_, done := p.done[step.FullName()]
+		if done || step.Manager != installer.Manager || step.FullName() == installer.FullName() ||
+			step.Skip != "" || step.Recipe.BuildOnly {
+			continue
+		}
+		ready := true
+		for _, dep := range step.Deps {
+			if err, ok := p.done[dep]; !ok || err != nil {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			batch = append(batch, step.Installer)
+		}
+	}
+	return batch
+}
+
+// installPackages installs the packages of installer, and those of the recipes it's batched with,
+// with a single run of their manager. Only the packages that aren't installed yet are installed.
+// The result of each recipe in the batch is recorded, so that they aren't installed again when traversal reaches them.
+func (p *applier) installPackages(installer runner.Installer) error {
+	start := time.Now()
+	m, _ := packages.Lookup(installer.Manager)
+	batch := p.batch(installer)
+	lists := make([][]string, len(batch))
+	for i, member := range batch {
+		lists[i] = member.Packages
+	}
+	pkgs := packages.Merge(lists...)
+
+	name := fmt.Sprintf("%-16s", installer.FQDN(installer.Recipe))
+	prefix := color.New(color.Bold).Sprint(name)
+	out := p.output(p.total, name)
+	var captured bytes.Buffer
+	// finish records the result of a member of the batch, returning err if it's installer.
+	// The other members are counted once they're recorded.
+	finish := func(member runner.Installer, status report.Status, msg string, err error) error {
+		p.record(member, start, status, msg, &captured)
+		if member.FullName() == installer.FullName() {
+			return err
+		}
+		p.total++
+		p.done[member.FullName()] = err
+		return nil
+	}
+
+	checkOut := runner.Output{Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+	if p.showOutput {
+		checkOut = out
+	}
+	var missingOut bytes.Buffer
+	checkOut.Stdout = io.MultiWriter(checkOut.Stdout, &missingOut)
+	err := p.run(installer, "check", checkOut.Tee(&captured), func(out runner.Output) error {
+		return p.ex.Run(p.ctx, m.Missing(pkgs), out)
+	})
+	out.Flush()
+	if err != nil {
+		failed := fmt.Errorf("%s\tcheck failed: %v", prefix, err)
+		for _, member := range batch[1:] {
+			finish(member, report.Failed, "check failed: "+err.Error(), failed)
+		}
+		return finish(installer, report.Failed, "check failed: "+err.Error(), failed)
+	}
+	missing := make(map[string]bool)
+	for _, pkg := range strings.Fields(missingOut.String()) {
+		missing[pkg] = true
+	}
+
+	var toInstall []runner.Installer
+	for _, member := range batch {
+		var need bool
+		for _, pkg := range member.Packages {
+			need = need || missing[pkg]
+		}
+		if need {
+			toInstall = append(toInstall, member)
+			continue
+		}
+		p.log.Info("%s\tcheck succeeded (%v)", color.New(color.Bold).Sprintf("%-16s", member.FQDN(member.Recipe)), time.Since(start))
+		finish(member, report.Passed, "", nil)
+	}
+	if len(toInstall) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, pkg := range pkgs {
+		if missing[pkg] {
+			names = append(names, pkg)
+		}
+	}
+	err = p.run(installer, "install", out.Tee(&captured), func(out runner.Output) error {
+		return p.ex.Run(p.ctx, m.Install(names), out)
+	})
+	out.Flush()
+	var result error
+	for _, member := range toInstall {
+		memberPrefix := color.New(color.Bold).Sprintf("%-16s", member.FQDN(member.Recipe))
+		if err != nil {
+			failed := fmt.Errorf("%s\tinstall failed: %v (%v)", memberPrefix, err, time.Since(start))
+			if err := finish(member, report.Failed, "install failed: "+err.Error(), failed); err != nil {
+				result = err
+			}
+			continue
+		}
+		p.log.Success("%s\tinstalled %s with %s (%v)", memberPrefix, strings.Join(member.Packages, " "), m.Name, time.Since(start))
+		finish(member, report.Passed, "installed", nil)
+		p.installed++
+	}
+	return result
+}
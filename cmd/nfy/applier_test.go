@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/clog"
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/report"
+	"cdr.dev/nfy/internal/runner"
+)
+
+// fakeBrew stands in for brew. Packages are installed by creating a file named after them in $STATE,
+// and each install is logged to $STATE/log.
+const fakeBrew = `#!/bin/sh
+case "$1" in
+list) test -e "$STATE/$3" ;;
+install) shift; echo "$*" >> "$STATE/log"; for pkg; do touch "$STATE/$pkg"; done ;;
+esac
+`
+
+func TestInstallPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nfy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "brew"), []byte(fakeBrew), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "htop"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := parse.Parse(strings.NewReader(`
+tools:
+  packages:
+    brew: [htop, wget]
+editor:
+  packages:
+    brew: [vim, wget]
+late:
+  packages:
+    brew: [jq]
+  deps:
+    - setup
+setup:
+  install: 'touch "$STATE/setup"'
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := graph.Generate(runner.FromParseRecipes(res.Recipes, ""), graph.RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	p := &applier{
+		ctx: context.Background(),
+		ex: runner.WithEnv(runner.Local{}, map[string]string{
+			"PATH":  dir + string(filepath.ListSeparator) + os.Getenv("PATH"),
+			"STATE": dir,
+		}),
+		log: clog.New(ioutil.Discard),
+		output: func(int, string) runner.Output {
+			return runner.Output{Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+		},
+		results: report.NewRecorder(),
+	}
+	err = p.apply(grp)
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	// tools and editor are ready together, so their missing packages are installed at once.
+	// late has to wait for setup.
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff("wget vim\njq\n", string(log)); diff != "" {
+		t.Errorf("unexpected installs (-want +got):\n%s", diff)
+	}
+
+	got := make(map[string]string)
+	for _, c := range p.results.Cases() {
+		if c.Status != report.Passed {
+			t.Errorf("%s: status %v: %s", c.Target, c.Status, c.Message)
+		}
+		got[c.Target] = c.Message
+	}
+	want := map[string]string{
+		"nfy:brew": "",
+		"tools":    "installed",
+		"editor":   "installed",
+		"setup":    "installed",
+		"late":     "installed",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected results (-want +got):\n%s", diff)
+	}
+	if p.total != 5 || p.installed != 4 {
+		t.Errorf("got total %v, installed %v, want 5 and 4", p.total, p.installed)
+	}
+}
+
+func TestApplyProbes(t *testing.T) {
+	res, err := parse.Parse(strings.NewReader(`
+snap:
+  check: "false"
+brew:
+  check: "false"
+aptx:
+  check: "true"
+tool:
+  check: "true"
+  install_brew:
+    script: "false"
+    deps: [brew]
+  install_apt:
+    script: "false"
+    deps: [aptx]
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := graph.Generate(runner.FromParseRecipes(res.Recipes, ""), graph.RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		targets   []string
+		checkOnly bool
+		wantErr   bool
+		want      map[string]report.Status
+	}{
+		// brew is only probed for tool's overloads, so it being missing isn't a failure.
+		{"Probe", []string{"tool"}, false, false, map[string]report.Status{"brew": report.Skipped, "aptx": report.Passed, "tool": report.Passed}},
+		{"ProbeCheckOnly", []string{"tool"}, true, false, map[string]report.Status{"brew": report.Skipped, "aptx": report.Passed, "tool": report.Passed}},
+		{"Requested", []string{"brew"}, false, true, map[string]report.Status{"brew": report.Failed}},
+		{"RequestedCheckOnly", []string{"brew"}, true, true, map[string]report.Status{"brew": report.Failed}},
+		// Checks go on after a requirement isn't met, so that the report covers every target.
+		{"CheckOnlyContinues", []string{"snap", "tool"}, true, true, map[string]report.Status{
+			"snap": report.Failed, "brew": report.Skipped, "aptx": report.Passed, "tool": report.Passed,
+		}},
+		// Without targets every recipe is requested, except those other recipes probe for.
+		{"Everything", nil, true, true, map[string]report.Status{
+			"snap": report.Failed, "brew": report.Skipped, "aptx": report.Passed, "tool": report.Passed,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			targets := grp
+			if tc.targets != nil {
+				targets = make(graph.RecipeIndex)
+				for _, name := range tc.targets {
+					targets[name] = grp[name]
+				}
+			}
+			p := &applier{
+				ctx: context.Background(),
+				ex:  runner.Local{},
+				log: clog.New(ioutil.Discard),
+				output: func(int, string) runner.Output {
+					return runner.Output{Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+				},
+				results:   report.NewRecorder(),
+				checkOnly: tc.checkOnly,
+			}
+			err := p.apply(targets)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, want error %v", err, tc.wantErr)
+			}
+
+			got := make(map[string]report.Status)
+			for _, c := range p.results.Cases() {
+				got[c.Target] = c.Status
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("unexpected results (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
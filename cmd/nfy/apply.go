@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+	"github.com/spf13/pflag"
+	"go.coder.com/cli"
+
+	"cdr.dev/nfy/internal/clog"
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/inventory"
+	"cdr.dev/nfy/internal/report"
+	"cdr.dev/nfy/internal/runner"
+)
+
+type applyCmd struct {
+	ctx context.Context
+
+	inventory  string
+	limit      []string
+	showOutput bool
+	ssh        string
+}
+
+func (a applyCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "apply",
+		Usage: "[flags]",
+		Desc:  "installs the nfy configuration on every host of an inventory",
+	}
+}
+
+func (a *applyCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVarP(&a.inventory, "inventory", "i", "inventory.yml", "inventory of hosts")
+	fl.StringSliceVarP(&a.limit, "limit", "l", nil, "only apply to these hosts")
+	fl.BoolVarP(&a.showOutput, "output", "o", false, "also show check output")
+	fl.StringVar(&a.ssh, "ssh", "ssh", "ssh client to reach hosts with")
+}
+
+// hostResult is the outcome of applying the graph to a host.
+type hostResult struct {
+	host inventory.Host
+	// targets are the targets selected for the host.
+	targets []string
+	results *report.Recorder
+	// err is set if the traversal stopped early.
+	err error
+}
+
+func (a *applyCmd) Run(fl *pflag.FlagSet) {
+	inv, err := inventory.Load(a.inventory)
+	if err != nil {
+		clog.Fatal("%v", err)
+	}
+	hosts, err := inv.Select(a.limit)
+	if err != nil {
+		clog.Fatal("%v", err)
+	}
+
+	graphIndex, config := localGraph(nil)
+	results := a.applyHosts(graphIndex, config.Vars, hosts, os.Stdout)
+	if failed := printHostMatrix(os.Stdout, graphIndex.Names(), results); failed > 0 {
+		clog.Fatal("%v of %v hosts had failures", failed, len(hosts))
+	}
+	clog.Success("applied to %v hosts", len(hosts))
+}
+
+// applyHosts applies the graph to each host concurrently.
+// The output of each host is written to w in one piece once the host is done, so that it isn't interleaved.
+// Scripts are rendered with vars, overridden by the vars of each host.
+func (a *applyCmd) applyHosts(graphIndex graph.RecipeIndex, vars map[string]string, hosts []inventory.Host, w io.Writer) []*hostResult {
+	var (
+		wg sync.WaitGroup
+		// wMu serializes the output of hosts.
+		wMu     sync.Mutex
+		results = make([]*hostResult, len(hosts))
+	)
+	// Unknown targets are fatal, so they're selected before anything is applied.
+	// The graphs share their loaders, so remote dependencies are only loaded by the first host needing them.
+	graphs := make([]graph.RecipeIndex, len(hosts))
+	for i, host := range hosts {
+		graphs[i] = selectTargets(graphIndex, host.Targets)
+	}
+
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host inventory.Host) {
+			defer wg.Done()
+			var (
+				buf   bytes.Buffer
+				outMu sync.Mutex
+			)
+			p := &applier{
+				ctx: a.ctx,
+				ex: runner.WithEnv(
+					runner.SSH{Host: host.Address, Command: a.ssh, Args: host.SSHArgs},
+					host.Vars,
+				),
+				log: clog.New(&buf),
+				output: func(n int, name string) runner.Output {
+					return runner.StreamOutput(&buf, &buf, &outMu,
+						color.New(prefixColors[n%len(prefixColors)]).Sprint(name+" | "),
+					)
+				},
+				results:    report.NewRecorder(),
+				showOutput: a.showOutput,
+				vars:       mergeVars(vars, host.Vars),
+			}
+			err := p.apply(graphs[i])
+			if err != nil {
+				p.log.Error("%+v", err)
+			}
+			results[i] = &hostResult{host: host, targets: graphs[i].Names(), results: p.results, err: err}
+
+			wMu.Lock()
+			defer wMu.Unlock()
+			fmt.Fprintf(w, "%s\n%s\n", color.New(color.Bold).Sprintf("==> %v (%v) <==", host.Name, host.Address), buf.Bytes())
+		}(i, host)
+	}
+	wg.Wait()
+	return results
+}
+
+// mergeVars returns the vars of base, overridden by those of override.
+func mergeVars(base, override map[string]string) map[string]string {
+	vars := make(map[string]string, len(base)+len(override))
+	for name, value := range base {
+		vars[name] = value
+	}
+	for name, value := range override {
+		vars[name] = value
+	}
+	return vars
+}
+
+// printHostMatrix prints the status of each host's targets, in the order of names,
+// returning the number of hosts with failures.
+// Dependencies aren't listed, and only fail a host if a target does, since an overloaded target may not need them.
+func printHostMatrix(w io.Writer, names []string, results []*hostResult) int {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "TARGET")
+	var (
+		statuses = make([]map[string]report.Case, len(results))
+		selected = make([]map[string]bool, len(results))
+		anyHost  = make(map[string]bool)
+		failed   int
+	)
+	for i, r := range results {
+		fmt.Fprintf(tw, "\t%v", r.host.Name)
+		statuses[i] = make(map[string]report.Case)
+		for _, c := range r.results.Cases() {
+			statuses[i][c.Target] = c
+		}
+		selected[i] = make(map[string]bool)
+		hostFailed := r.err != nil
+		for _, target := range r.targets {
+			selected[i][target] = true
+			anyHost[target] = true
+			if statuses[i][target].Status == report.Failed {
+				hostFailed = true
+			}
+		}
+		if hostFailed {
+			failed++
+		}
+	}
+	fmt.Fprintln(tw)
+
+	for _, target := range names {
+		if !anyHost[target] {
+			continue
+		}
+		fmt.Fprint(tw, target)
+		for i := range results {
+			cell := "-"
+			if c, ok := statuses[i][target]; ok && selected[i][target] {
+				switch c.Status {
+				case report.Passed:
+					cell = "ok"
+					if c.Message != "" {
+						cell = c.Message
+					}
+				case report.Failed:
+					cell = "FAILED"
+				case report.Skipped:
+					cell = "skipped"
+				}
+			}
+			fmt.Fprintf(tw, "\t%v", cell)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	return failed
+}
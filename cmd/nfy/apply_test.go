@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/inventory"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+	"cdr.dev/nfy/internal/sshtest"
+)
+
+// ansi matches terminal escape sequences, which color output if the tests run in a terminal.
+var ansi = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func TestApplyHosts(t *testing.T) {
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("the ssh client isn't installed")
+	}
+	dir, err := ioutil.TempDir("", "nfy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each host is a stand-in server, which tells scripts which host they run on with SSH_HOST.
+	servers := make(map[string]*sshtest.Server)
+	for _, name := range []string{"web", "db", "cache"} {
+		s, err := sshtest.NewServer("SSH_HOST=" + name)
+		if err != nil {
+			t.Fatalf("ssh server: %v", err)
+		}
+		defer s.Close()
+		servers[name] = s
+	}
+	sshArgs := func(name string) string {
+		return `["` + strings.Join(servers[name].Args(), `", "`) + `"]`
+	}
+
+	res, err := parse.Parse(strings.NewReader(`
+brew:
+  check: "false"
+tool:
+  check: 'test -e "$STATE/$SSH_HOST.tool"'
+  install_brew:
+    script: "brew install tool"
+    deps: [brew]
+  install_sh:
+    script: 'touch "$STATE/$SSH_HOST.tool"'
+web-only:
+  check: "false"
+  install: 'echo "{{ .Vars.VERB }} {{ .Name }} for {{ .Vars.ROLE }}"; test "$ROLE" = web'
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := graph.Generate(runner.FromParseRecipes(res.Recipes, ""), graph.RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	inv, err := inventory.Parse(strings.NewReader(fmt.Sprintf(`
+vars:
+  STATE: %s
+hosts:
+  - name: web
+    address: deploy@127.0.0.1
+    ssh_args: %s
+    targets: [tool, web-only]
+    vars:
+      ROLE: web
+  - name: db
+    address: 127.0.0.1
+    ssh_args: %s
+    targets: [tool, web-only]
+    vars:
+      ROLE: db
+  - name: cache
+    address: 127.0.0.1
+    ssh_args: %s
+    targets: [tool]
+`, dir, sshArgs("web"), sshArgs("db"), sshArgs("cache"))))
+	if err != nil {
+		t.Fatalf("inventory: %v", err)
+	}
+
+	// brew is only probed for tool, so it isn't listed and doesn't fail the hosts.
+	a := &applyCmd{ctx: context.Background(), ssh: "ssh"}
+	for _, want := range []string{
+		`TARGET    web        db         cache
+tool      installed  installed  installed
+web-only  installed  FAILED     -
+`,
+		// The checks run on each host, so tool isn't installed again.
+		`TARGET    web        db      cache
+tool      ok         ok      ok
+web-only  installed  FAILED  -
+`,
+	} {
+		var out, matrix bytes.Buffer
+		results := a.applyHosts(grp, map[string]string{"VERB": "installing", "ROLE": "nobody"}, inv.Hosts, &out)
+		failed := printHostMatrix(&matrix, grp.Names(), results)
+		if matrix.String() != want {
+			t.Errorf("unexpected matrix:\n%s", cmp.Diff(want, matrix.String()))
+		}
+		if failed != 1 {
+			t.Errorf("got %v failed hosts, want 1", failed)
+		}
+
+		// Each host's output is kept together.
+		output := ansi.ReplaceAllString(out.String(), "")
+		for _, host := range []string{"==> web (deploy@127.0.0.1) <==", "==> db (127.0.0.1) <==", "==> cache (127.0.0.1) <=="} {
+			if !strings.Contains(output, host) {
+				t.Errorf("output has no section for %q:\n%s", host, output)
+			}
+		}
+		db := output[strings.Index(output, "==> db"):]
+		if i := strings.Index(db[1:], "==>"); i >= 0 {
+			db = db[:i+1]
+		}
+		// Scripts are rendered with the host's vars.
+		if !strings.Contains(db, "installing web-only for db") {
+			t.Errorf("db section lacks its install output:\n%s", db)
+		}
+	}
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
+	"cdr.dev/nfy/internal/builder"
+	"cdr.dev/nfy/internal/clog"
+	"cdr.dev/nfy/internal/facts"
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/parse"
 	"context"
 	"fmt"
 	"github.com/spf13/pflag"
 	"go.coder.com/cli"
-	"cdr.dev/nfy/internal/builder"
-	"cdr.dev/nfy/internal/clog"
 	"io/ioutil"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"strings"
 )
 
@@ -18,47 +19,132 @@ type buildCmd struct {
 	ctx context.Context
 
 	targets    []string
-	base       string
+	bases      []string
+	prefer     []string
 	dockerFile bool
+	guard      bool
+	verify     bool
+	layers     string
+
+	engine     string
+	contextDir string
+	buildArgs  []string
+	noCache    bool
+	platform   string
+	labels     []string
+
+	from string
 }
 
 func (a buildCmd) Spec() cli.CommandSpec {
 	return cli.CommandSpec{
 		Name:  "build",
-		Usage: "[flags] -b <base> <image_name>",
-		Desc:  "builds a Docker image",
+		Usage: "[flags] -b <base>... <image_name>",
+		Desc:  "builds a container image",
 	}
 }
 
 func (a *buildCmd) RegisterFlags(fl *pflag.FlagSet) {
 	fl.StringSliceVarP(&a.targets, "targets", "t", nil, "only install specific targets")
-	fl.StringVarP(&a.base, "base", "b", "", "base image for FROM clause")
+	fl.StringArrayVarP(&a.bases, "base", "b", nil, "base image for FROM clause, repeat to build an image on each base")
+	fl.StringSliceVar(&a.prefer, "prefer", nil, "installers to try first (e.g apt), ahead of build_prefer")
 	fl.BoolVarP(&a.dockerFile, "dockerfile", "f", false, "just print the Dockerfile")
+	fl.BoolVar(&a.guard, "guard", false, "skip installs whose check already passes in the base image")
+	fl.BoolVar(&a.verify, "verify", false, "run checks after installs and fail the build if they don't pass")
+	fl.StringVar(&a.layers, "layers", "recipe", `group recipes into layers: "recipe", "depth" or a maximum number of layers`)
+	fl.StringVar(&a.engine, "engine", "docker", "build with docker, podman or buildah")
+	fl.StringVar(&a.contextDir, "context-dir", "", "write the build context to this directory instead of building")
+	fl.StringArrayVar(&a.buildArgs, "build-arg", nil, "KEY=VALUE build arguments passed to the engine")
+	fl.BoolVar(&a.noCache, "no-cache", false, "don't use the engine's layer cache")
+	fl.StringVar(&a.platform, "platform", "", "target platform, e.g linux/arm64")
+	fl.StringArrayVar(&a.labels, "label", nil, "KEY=VALUE labels for the image")
+	fl.StringVar(&a.from, "from", "", "build on a previous nfy image, only installing recipes that changed")
 }
 
 func (a *buildCmd) Run(fl *pflag.FlagSet) {
-	if a.base == "" {
+	if len(a.bases) == 0 && a.from == "" {
 		clog.Fatal("-b (base) required")
 	}
+	if len(a.bases) > 1 && a.from != "" {
+		clog.Fatal("--from can't be combined with several bases")
+	}
 	imageName := fl.Arg(0)
-	if imageName == "" {
+	if imageName == "" && a.contextDir == "" {
 		clog.Error("image name must be provided")
 		fl.Usage()
 		os.Exit(1)
 	}
 
-	graphIndex := localGraph(a.targets)
-	dfile, err := builder.Dockerfile(a.ctx, a.base, graphIndex)
+	layers, err := builder.ParseLayers(a.layers)
+	if err != nil {
+		clog.Fatal("%v", err)
+	}
+	engine, err := builder.ParseEngine(a.engine)
+	if err != nil {
+		clog.Fatal("%v", err)
+	}
+
+	var (
+		base     string
+		previous *builder.ImageInfo
+	)
+	if len(a.bases) > 0 {
+		base = a.bases[0]
+	}
+	if a.from != "" {
+		previous = imageInfo(a.ctx, engine, a.from)
+		// Installers are selected for the base the previous image started from.
+		if base == "" {
+			base = previous.Base
+		}
+	}
+
+	var argNames []string
+	for _, arg := range a.buildArgs {
+		argNames = append(argNames, strings.SplitN(arg, "=", 2)[0])
+	}
+	opts := builder.Options{
+		Guard:    a.guard,
+		Verify:   a.verify,
+		Layers:   layers,
+		Args:     argNames,
+		Version:  version,
+		From:     a.from,
+		Previous: previous,
+	}
+
+	graphIndex, config := localGraph(a.targets)
+	if len(a.bases) > 1 {
+		a.matrix(engine, imageName, graphIndex, config, opts)
+		return
+	}
+	dctx, err := a.dockerfile(graphIndex, config, base, opts)
 	if err != nil {
 		clog.Fatal("dockerfile build failed: %+v", err)
 	}
+	for _, name := range dctx.Removed {
+		clog.Warn("%v is no longer in the config, but can't be removed from %v", name, a.from)
+	}
 	if a.dockerFile {
 		fmt.Printf("%v\n",
-			strings.TrimSpace(dfile),
+			strings.TrimSpace(dctx.Dockerfile),
 		)
 		return
 	}
 
+	if a.contextDir != "" {
+		err = os.MkdirAll(a.contextDir, 0750)
+		if err != nil {
+			clog.Fatal("create context dir failed: %v", err)
+		}
+		err = dctx.Write(a.contextDir)
+		if err != nil {
+			clog.Fatal("write build context failed: %v", err)
+		}
+		clog.Success("wrote build context to %v", a.contextDir)
+		return
+	}
+
 	// Prepare build context.
 	dir, err := ioutil.TempDir("", "nfy")
 	if err != nil {
@@ -66,19 +152,40 @@ func (a *buildCmd) Run(fl *pflag.FlagSet) {
 	}
 	defer os.RemoveAll(dir)
 
-	err = ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dfile), 0640)
+	err = dctx.Write(dir)
 	if err != nil {
-		clog.Fatal("write Dockerfile failed: %v", err)
+		clog.Fatal("write build context failed: %v", err)
 	}
 
-	// Execute Docker build.
-	cmd := exec.Command("docker", "build", "-t", imageName, ".")
-	cmd.Dir = dir
+	cmd := engine.Command(a.ctx, dir, a.buildOptions(imageName))
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 	err = cmd.Run()
 	if err != nil {
-		clog.Fatal("docker build: %v", err)
+		clog.Fatal("%v build: %v", engine, err)
+	}
+}
+
+// dockerfile generates the Dockerfile for base, preferring the installers suited to it
+// and leaving out those whose when conditions don't match the facts guessed for it.
+// Scripts are rendered with those facts too.
+func (a *buildCmd) dockerfile(graphIndex graph.RecipeIndex, config *parse.Result, base string, opts builder.Options) (*builder.Context, error) {
+	prefs := append(append([]string(nil), a.prefer...), builder.Preferences(base, config.BuildPrefer)...)
+	clog.Debug("%v: preferring installers %v", base, prefs)
+	f := facts.ForImage(base, a.platform)
+	clog.Debug("%v: assuming facts %+v", base, f)
+	opts.Base = base
+	graphIndex = graphIndex.Prefer(prefs).When(f.Match).Render(graph.TemplateData{Facts: &f, Vars: config.Vars})
+	return builder.Dockerfile(a.ctx, graphIndex, opts)
+}
+
+func (a *buildCmd) buildOptions(image string) builder.BuildOptions {
+	return builder.BuildOptions{
+		Image:     image,
+		BuildArgs: a.buildArgs,
+		NoCache:   a.noCache,
+		Platform:  a.platform,
+		Labels:    a.labels,
 	}
 }
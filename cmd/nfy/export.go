@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/pflag"
+	"go.coder.com/cli"
+
+	"cdr.dev/nfy/internal/clog"
+	"cdr.dev/nfy/internal/export"
+	"cdr.dev/nfy/internal/graph"
+)
+
+type exportCmd struct {
+	ctx context.Context
+
+	targets []string
+	format  string
+	output  string
+}
+
+func (a exportCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "export",
+		Usage: "[flags]",
+		Desc:  "exports the nfy configuration so that it can be applied without nfy",
+	}
+}
+
+func (a *exportCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringSliceVarP(&a.targets, "targets", "t", nil, "only export specific targets")
+	fl.StringVar(&a.format, "format", "sh", `output format: "sh" or "cloud-init"`)
+	fl.StringVarP(&a.output, "output", "o", "", "write to a file instead of stdout")
+}
+
+func (a *exportCmd) Run(fl *pflag.FlagSet) {
+	graphIndex, config := localGraph(a.targets)
+	// The system the export runs on isn't known, so scripts can't refer to facts. Conditions can use when instead.
+	graphIndex = graphIndex.Render(graph.TemplateData{Vars: config.Vars})
+
+	var (
+		out string
+		err error
+	)
+	switch a.format {
+	case "sh":
+		out, err = export.Shell(a.ctx, graphIndex, export.Options{})
+	case "cloud-init":
+		out, err = export.CloudInit(a.ctx, graphIndex, export.Options{})
+	default:
+		clog.Fatal("unknown format %q", a.format)
+	}
+	if err != nil {
+		clog.Fatal("export failed: %+v", err)
+	}
+
+	if a.output == "" {
+		fmt.Print(out)
+		return
+	}
+	err = ioutil.WriteFile(a.output, []byte(out), 0755)
+	if err != nil {
+		clog.Fatal("write %v: %v", a.output, err)
+	}
+	clog.Success("exported to %v", a.output)
+}
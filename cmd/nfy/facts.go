@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+	"go.coder.com/cli"
+
+	"cdr.dev/nfy/internal/clog"
+	"cdr.dev/nfy/internal/facts"
+)
+
+type factsCmd struct {
+	ctx context.Context
+
+	container string
+	host      string
+}
+
+func (a factsCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "facts",
+		Usage: "[flags]",
+		Desc:  "prints the facts that when conditions are matched against",
+	}
+}
+
+func (a *factsCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVar(&a.container, "container", "", "detect the facts of a running container")
+	fl.StringVar(&a.host, "host", "", "detect the facts of a remote host over ssh, e.g user@box")
+}
+
+func (a *factsCmd) Run(fl *pflag.FlagSet) {
+	f, err := facts.Gather(a.ctx, selectExecutor(a.container, a.host))
+	if err != nil {
+		clog.Fatal("%v", err)
+	}
+	values := f.Values()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, name := range facts.Names {
+		fmt.Fprintf(w, "%s\t%s\n", name, strings.Join(values[name], " "))
+	}
+	w.Flush()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+	"go.coder.com/cli"
+
+	"cdr.dev/nfy/internal/builder"
+	"cdr.dev/nfy/internal/clog"
+)
+
+type inspectImageCmd struct {
+	ctx context.Context
+
+	engine string
+}
+
+func (a inspectImageCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "inspect-image",
+		Usage: "[flags] <image_name>",
+		Desc:  "shows which recipes an image built by nfy contains",
+	}
+}
+
+func (a *inspectImageCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringVar(&a.engine, "engine", "docker", "inspect with docker, podman or buildah")
+}
+
+// imageInfo reads the nfy labels of a local image.
+func imageInfo(ctx context.Context, engine builder.Engine, image string) *builder.ImageInfo {
+	labels, err := engine.InspectLabels(ctx, image)
+	if err != nil {
+		clog.Fatal("%v", err)
+	}
+	info, err := builder.ParseLabels(labels)
+	if err != nil {
+		clog.Fatal("%v: %v", image, err)
+	}
+	return info
+}
+
+func (a *inspectImageCmd) Run(fl *pflag.FlagSet) {
+	image := fl.Arg(0)
+	if image == "" {
+		clog.Error("image name must be provided")
+		fl.Usage()
+		os.Exit(1)
+	}
+	engine, err := builder.ParseEngine(a.engine)
+	if err != nil {
+		clog.Fatal("%v", err)
+	}
+
+	info := imageInfo(a.ctx, engine, image)
+	fmt.Printf("nfy version: %v\n", info.Version)
+	fmt.Printf("targets:     %v\n", info.Targets)
+	for _, remote := range info.Remotes {
+		fmt.Printf("remote:      %v\n", remote)
+	}
+	fmt.Printf("recipes:\n")
+	for _, name := range info.RecipeNames() {
+		fmt.Printf("  %-24s %v\n", name, info.Recipes[name])
+	}
+}
@@ -1,19 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"cdr.dev/nfy/internal/clog"
 	"cdr.dev/nfy/internal/graph"
 	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/report"
 	"cdr.dev/nfy/internal/runner"
 	"context"
-	"fmt"
 	"github.com/fatih/color"
 	"github.com/spf13/pflag"
 	"go.coder.com/cli"
 	"os"
 	"path/filepath"
-	"time"
+	"sync"
 )
 
 type installCmd struct {
@@ -21,22 +20,62 @@ type installCmd struct {
 
 	showOutput bool
 	targets    []string
+	logDir     string
+	junit      string
+	checkOnly  bool
+	container  string
+	host       string
 }
 
 func (a installCmd) Spec() cli.CommandSpec {
 	return cli.CommandSpec{
 		Name:  "install",
 		Usage: "",
-		Desc:  "installs the nfy configuration to the local system",
+		Desc:  "installs the nfy configuration to the local system, a container or a remote host",
 	}
 }
 
 func (a *installCmd) RegisterFlags(fl *pflag.FlagSet) {
-	fl.BoolVarP(&a.showOutput, "output", "o", false, "always show script output")
+	fl.BoolVarP(&a.showOutput, "output", "o", false, "also show check output")
 	fl.StringSliceVarP(&a.targets, "targets", "t", nil, "only install specific targets")
+	fl.StringVar(&a.junit, "junit", "", "write a JUnit XML report to this path")
+	fl.BoolVarP(&a.checkOnly, "check-only", "c", false, "only run checks, never install")
+	fl.StringVar(&a.logDir, "log-dir", "", "write the output of every check and install to a file in this directory")
+	fl.StringVar(&a.container, "container", "", "install in a running container with docker exec")
+	fl.StringVar(&a.host, "host", "", "install on a remote host over ssh, e.g user@box")
 }
 
-func localGraph(targets []string) graph.RecipeIndex {
+// executor returns the executor for the system the flags select.
+func (a installCmd) executor() runner.Executor {
+	return selectExecutor(a.container, a.host)
+}
+
+// selectExecutor returns the executor for a container or host, or the local system if neither is set.
+func selectExecutor(container, host string) runner.Executor {
+	switch {
+	case container != "" && host != "":
+		clog.Fatal("--container and --host are mutually exclusive")
+	case container != "":
+		return runner.DockerExec{Container: container}
+	case host != "":
+		return runner.SSH{Host: host}
+	}
+	return runner.Local{}
+}
+
+// localGraph loads the graph of the local configuration.
+// The parsed configuration is returned for its settings.
+func localGraph(targets []string) (graph.RecipeIndex, *parse.Result) {
+	graphIndex, config := loadConfig()
+	err := graphIndex.Validate()
+	if err != nil {
+		clog.Fatal("%v", err)
+	}
+	return selectTargets(graphIndex, targets), config
+}
+
+// loadConfig parses the local configuration and generates its graph, without validating it.
+func loadConfig() (graph.RecipeIndex, *parse.Result) {
 	var err error
 	path := os.Getenv("NFY_PATH")
 	if path == "" {
@@ -48,102 +87,124 @@ func localGraph(targets []string) graph.RecipeIndex {
 	}
 	clog.Debug("using path: %v", path)
 
-	var parsedRecipes []parse.Recipe
+	var config parse.Result
 	root := filepath.Join(path, "nfy.yml")
-	err = parse.Traverse(&parsedRecipes, root)
+	err = parse.Traverse(&config, root)
 	if err != nil {
 		clog.Fatal("%v", err)
 	}
 
-	graphIndex, err := graph.Generate(runner.FromParseRecipes(parsedRecipes, ""), graph.RemoteConfig{Path: path})
+	graphIndex, err := graph.Generate(runner.FromParseRecipes(config.Recipes, ""), graph.RemoteConfig{Path: path})
 	if err != nil {
 		clog.Fatal("%+v", err)
 	}
+	return graphIndex, &config
+}
 
+// selectTargets returns the recipes of graphIndex named by targets, or every recipe if targets is nil.
+func selectTargets(graphIndex graph.RecipeIndex, targets []string) graph.RecipeIndex {
 	// If no specify targets are specified, evaluate all.
 	if targets == nil {
 		return graphIndex
 	}
 
 	// Replace the graphIndex with a filtered version if targets are specified.
-	return func() graph.RecipeIndex {
-		newIndex := make(graph.RecipeIndex)
-		for _, v := range targets {
-			recipe, ok := graphIndex[v]
-			if !ok {
-				graphIndex.Dump()
-				clog.Fatal("no recipe %q not found", v)
-			}
-			newIndex[v] = recipe
+	newIndex := make(graph.RecipeIndex)
+	for _, v := range targets {
+		if name, args, ok := parse.ParseInstance(v); ok {
+			v = parse.InstanceName(name, args)
+		}
+		recipe, ok := graphIndex[v]
+		if !ok {
+			graphIndex.Dump()
+			clog.Fatal("no recipe %q not found", v)
 		}
-		return newIndex
-	}()
+		newIndex[v] = recipe
+	}
+	return newIndex
+}
+
+// prefixColors are cycled through to tell apart the output of different targets.
+var prefixColors = []color.Attribute{
+	color.FgCyan,
+	color.FgYellow,
+	color.FgGreen,
+	color.FgMagenta,
+	color.FgBlue,
+	color.FgHiCyan,
+	color.FgHiYellow,
+	color.FgHiGreen,
+	color.FgHiMagenta,
+	color.FgHiBlue,
 }
 
 func (a installCmd) Run(fl *pflag.FlagSet) {
-	var (
-		totalCounter   int
-		installCounter int
-	)
-
-	graphIndex := localGraph(a.targets)
-	err := graphIndex.Traverse(
-		a.ctx,
-		graph.TraverseOnce(
-			func(installer runner.Installer) error {
-				totalCounter++
-				if installer.DependencyOnly() || installer.Recipe.BuildOnly {
-					return nil
-				}
-
-				// TODO: sync.
-				var outBuf bytes.Buffer
-				out := runner.Output{
-					Stderr: &outBuf,
-					Stdout: &outBuf,
-				}
-
-				prefix := color.New(color.Bold).Sprint(
-					fmt.Sprintf("%-16s", installer.FQDN(installer.Recipe)),
-					)
-
-				start := time.Now()
-				if installer.Recipe.Check != "" {
-					err := installer.Check(out)
-					if a.showOutput {
-						clog.Info("%s\t --- begin check output", prefix)
-						outBuf.WriteTo(os.Stdout)
-						clog.Info("%s\t --- end check output", prefix)
-					}
-					if err == nil {
-						clog.Info("%s\tcheck succeeded (%v)", prefix, time.Since(start))
-						return nil
-					}
-				}
-
-				err := installer.Install(out)
-				if err != nil {
-					outBuf.WriteTo(os.Stdout)
-					return fmt.Errorf("%s\tinstall failed: %v (%v)", prefix, err, time.Since(start))
-				}
-				var noCheckMessage string
-				if installer.Recipe.Check == "" {
-					noCheckMessage = "no check, "
-				}
-				clog.Success("%s\t%sinstalled (%v)", prefix, noCheckMessage, time.Since(start))
-				if a.showOutput {
-					clog.Info("%s\t --- begin install output")
-					outBuf.WriteTo(os.Stdout)
-					clog.Info("%s\t --- end install output")
-				}
-
-				installCounter++
-				return nil
-			},
-		),
-	)
+	var logs *runner.LogDir
+	if a.logDir != "" {
+		var err error
+		logs, err = runner.OpenLogDir(a.logDir)
+		if err != nil {
+			clog.Fatal("%v", err)
+		}
+	}
+
+	// outMu serializes script output lines across targets.
+	var outMu sync.Mutex
+	p := &applier{
+		ctx: a.ctx,
+		ex:  a.executor(),
+		log: clog.New(os.Stderr),
+		output: func(n int, name string) runner.Output {
+			return runner.StreamOutput(os.Stdout, os.Stderr, &outMu,
+				color.New(prefixColors[n%len(prefixColors)]).Sprint(name+" | "),
+			)
+		},
+		logs:       logs,
+		results:    report.NewRecorder(),
+		showOutput: a.showOutput,
+		checkOnly:  a.checkOnly,
+	}
+
+	graphIndex, config := localGraph(a.targets)
+	p.vars = config.Vars
+	if _, ok := p.ex.(runner.Local); !ok {
+		clog.Info("installing on %v", p.ex)
+	}
+	err := p.apply(graphIndex)
+	if logs != nil {
+		if err := logs.WriteIndex(); err != nil {
+			clog.Error("write log index: %v", err)
+		}
+		clog.Info("logs written to %v", a.logDir)
+	}
+	if a.junit != "" {
+		if err := writeJUnit(a.junit, p.results); err != nil {
+			clog.Error("write junit report: %v", err)
+		}
+	}
 	if err != nil {
 		clog.Fatal("%+v", err)
 	}
-	clog.Success("total: %v, installed: %v", totalCounter, installCounter)
+	if a.checkOnly {
+		if n := p.results.Failed(); n > 0 {
+			clog.Fatal("total: %v, failed checks: %v", p.total, n)
+		}
+		clog.Success("total: %v, all checks passed", p.total)
+		return
+	}
+	clog.Success("total: %v, installed: %v", p.total, p.installed)
+}
+
+func writeJUnit(path string, results *report.Recorder) error {
+	fi, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	err = results.WriteJUnit(fi, "nfy")
+	if err != nil {
+		return err
+	}
+	return fi.Close()
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fatih/color"
+	"github.com/spf13/pflag"
+	"go.coder.com/cli"
+
+	"cdr.dev/nfy/internal/clog"
+	"cdr.dev/nfy/internal/lint"
+)
+
+type lintCmd struct {
+	ctx context.Context
+
+	targets []string
+	strict  bool
+}
+
+func (a lintCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "lint",
+		Usage: "[flags]",
+		Desc:  "checks the nfy configuration for mistakes",
+	}
+}
+
+func (a *lintCmd) RegisterFlags(fl *pflag.FlagSet) {
+	fl.StringSliceVarP(&a.targets, "targets", "t", nil, "report recipes these targets don't reach")
+	fl.BoolVar(&a.strict, "strict", false, "fail on warnings too")
+}
+
+func (a *lintCmd) Run(fl *pflag.FlagSet) {
+	graphIndex, config := loadConfig()
+	problems := lint.Lint(a.ctx, config, graphIndex, lint.Options{Targets: a.targets})
+	wd, _ := os.Getwd()
+	var errors int
+	for _, p := range problems {
+		// Relative paths are shorter, and clickable in editors.
+		if rel, err := filepath.Rel(wd, p.Pos.File); err == nil && p.Pos.File != "" {
+			p.Pos.File = rel
+		}
+		c := color.FgYellow
+		if p.Severity == lint.Error {
+			c = color.FgRed
+			errors++
+		}
+		fmt.Printf("%v: %v: %v %v\n", p.Pos, color.New(c).Sprint(p.Severity), p.Message, color.New(color.Faint).Sprintf("(%v)", p.Check))
+	}
+	if lint.Failed(problems, a.strict) {
+		clog.Fatal("%v errors, %v warnings", errors, len(problems)-errors)
+	}
+	clog.Success("%v errors, %v warnings", errors, len(problems)-errors)
+}
@@ -9,6 +9,9 @@ import (
 	"os/signal"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 type rootCmd struct {
 	ctx context.Context
 }
@@ -26,6 +29,11 @@ func (c *rootCmd) Subcommands() []cli.Command {
 	return []cli.Command{
 		&installCmd{ctx: c.ctx},
 		&buildCmd{ctx: c.ctx},
+		&exportCmd{ctx: c.ctx},
+		&inspectImageCmd{ctx: c.ctx},
+		&applyCmd{ctx: c.ctx},
+		&lintCmd{ctx: c.ctx},
+		&factsCmd{ctx: c.ctx},
 	}
 }
 
@@ -37,7 +45,7 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	go func() {
-		sigs := make(chan os.Signal)
+		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, os.Interrupt)
 		for s := range sigs {
 			cancel()
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+
+	"cdr.dev/nfy/internal/builder"
+	"cdr.dev/nfy/internal/clog"
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+// matrixBuild is the build of the image for one of several bases.
+type matrixBuild struct {
+	base  string
+	image string
+	dctx  *builder.Context
+	// status is the status of each recipe, read from the built image.
+	status map[string]builder.Status
+	err    error
+}
+
+// matrix builds an image on each base concurrently, then prints which targets installed on which bases.
+// Failing recipes don't fail the builds, so that every base is reported on in full.
+func (a *buildCmd) matrix(engine builder.Engine, imageName string, graphIndex graph.RecipeIndex, config *parse.Result, opts builder.Options) {
+	opts.Record = true
+	builds := make([]*matrixBuild, len(a.bases))
+	for i, base := range a.bases {
+		b := &matrixBuild{base: base, image: builder.ImageForBase(imageName, base)}
+		b.dctx, b.err = a.dockerfile(graphIndex, config, base, opts)
+		if b.err != nil {
+			clog.Fatal("%v: dockerfile build failed: %+v", base, b.err)
+		}
+		builds[i] = b
+	}
+
+	if a.dockerFile {
+		for _, b := range builds {
+			fmt.Printf("# %v\n%v\n\n", b.base, strings.TrimSpace(b.dctx.Dockerfile))
+		}
+		return
+	}
+
+	if a.contextDir != "" {
+		for _, b := range builds {
+			dir := filepath.Join(a.contextDir, builder.BaseTag(b.base))
+			err := os.MkdirAll(dir, 0750)
+			if err != nil {
+				clog.Fatal("create context dir failed: %v", err)
+			}
+			err = b.dctx.Write(dir)
+			if err != nil {
+				clog.Fatal("write build context failed: %v", err)
+			}
+			clog.Success("wrote build context for %v to %v", b.base, dir)
+		}
+		return
+	}
+
+	var (
+		wg sync.WaitGroup
+		// outMu serializes build output lines across bases.
+		outMu sync.Mutex
+	)
+	for i, b := range builds {
+		wg.Add(1)
+		go func(b *matrixBuild, c color.Attribute) {
+			defer wg.Done()
+			out := runner.StreamOutput(os.Stdout, os.Stderr, &outMu,
+				color.New(c).Sprint(fmt.Sprintf("%-16s", b.base)+" | "),
+			)
+			b.status, b.err = a.buildBase(engine, b, out)
+			out.Flush()
+		}(b, prefixColors[i%len(prefixColors)])
+	}
+	wg.Wait()
+
+	failed := printMatrix(os.Stdout, graphIndex.Names(), builds)
+	if failed > 0 {
+		clog.Fatal("%v of %v bases had failures", failed, len(builds))
+	}
+	clog.Success("all targets installed on %v bases", len(builds))
+}
+
+// buildBase builds the image of b and reads the status of its recipes.
+func (a *buildCmd) buildBase(engine builder.Engine, b *matrixBuild, out runner.Output) (map[string]builder.Status, error) {
+	dir, err := ioutil.TempDir("", "nfy")
+	if err != nil {
+		return nil, fmt.Errorf("create tempdir failed: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = b.dctx.Write(dir)
+	if err != nil {
+		return nil, fmt.Errorf("write build context failed: %w", err)
+	}
+
+	cmd := engine.Command(a.ctx, dir, a.buildOptions(b.image))
+	cmd.Stdout = out.Stdout
+	cmd.Stderr = out.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%v build: %w", engine, err)
+	}
+
+	status, err := engine.ReadFile(a.ctx, b.image, builder.StatusFile)
+	if err != nil {
+		return nil, err
+	}
+	return builder.ParseStatus(status)
+}
+
+// printMatrix prints the status of each target on each base, returning the number of bases with failures.
+func printMatrix(w io.Writer, targets []string, builds []*matrixBuild) int {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "TARGET")
+	for _, b := range builds {
+		fmt.Fprintf(tw, "\t%v", b.base)
+	}
+	fmt.Fprintln(tw)
+
+	failed := make(map[*matrixBuild]bool)
+	for _, target := range targets {
+		fmt.Fprint(tw, target)
+		for _, b := range builds {
+			cell := "-"
+			switch b.status[target] {
+			case builder.StatusOK:
+				cell = "ok"
+			case builder.StatusFailed:
+				cell = "FAILED"
+				failed[b] = true
+			case builder.StatusSkipped:
+				cell = "skipped"
+				failed[b] = true
+			}
+			if b.err != nil {
+				cell = "error"
+			}
+			fmt.Fprintf(tw, "\t%v", cell)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+
+	for _, b := range builds {
+		if b.err != nil {
+			failed[b] = true
+			clog.Error("%v: %v", b.base, b.err)
+		}
+	}
+	return len(failed)
+}
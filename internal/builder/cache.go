@@ -0,0 +1,43 @@
+package builder
+
+import (
+	"fmt"
+	"strings"
+
+	"cdr.dev/nfy/internal/graph"
+)
+
+// syntaxHeader selects a Dockerfile frontend that supports cache mounts.
+const syntaxHeader = "# syntax=docker/dockerfile:1\n"
+
+// cacheTarget expands a leading ~ in dir to the home directory of root, which RUN instructions run as.
+func cacheTarget(dir string) string {
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		return "/root" + dir[1:]
+	}
+	return dir
+}
+
+// mounts returns the flags for a RUN instruction that mount the cache directories of the steps.
+// Caches are kept per base, since the caches of different distributions aren't interchangeable,
+// and are locked so that concurrent builds don't corrupt them.
+func (d *dockerfile) mounts(steps []graph.Step) string {
+	var (
+		s    strings.Builder
+		seen = make(map[string]bool)
+	)
+	for _, step := range steps {
+		for _, dir := range step.Recipe.CacheDirs {
+			target := cacheTarget(dir)
+			if seen[target] {
+				continue
+			}
+			seen[target] = true
+			fmt.Fprintf(&s, "--mount=type=cache,id=%s%s,target=%s,sharing=locked ", BaseTag(d.base()), target, target)
+		}
+	}
+	if s.Len() > 0 {
+		d.cached = true
+	}
+	return s.String()
+}
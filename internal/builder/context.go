@@ -0,0 +1,45 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Context is a Docker build context.
+type Context struct {
+	Dockerfile string
+	// Files maps slash separated paths, relative to the root of the context, to their contents.
+	Files map[string][]byte
+	// Removed lists the recipes of the previous image (see Options.From) that are no longer in the config.
+	// They can't be removed from the image.
+	Removed []string
+}
+
+func (c *Context) addFile(path string, contents []byte) {
+	if c.Files == nil {
+		c.Files = make(map[string][]byte)
+	}
+	c.Files[path] = contents
+}
+
+// Write writes the Dockerfile and every file of the context into dir.
+func (c *Context) Write(dir string) error {
+	err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(c.Dockerfile), 0640)
+	if err != nil {
+		return fmt.Errorf("write Dockerfile: %w", err)
+	}
+	for path, contents := range c.Files {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		err = os.MkdirAll(filepath.Dir(path), 0750)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, contents, 0640)
+		if err != nil {
+			return fmt.Errorf("write %v: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -3,30 +3,297 @@ package builder
 import (
 	"context"
 	"fmt"
+	"strings"
+
 	"cdr.dev/nfy/internal/graph"
 	"cdr.dev/nfy/internal/runner"
-	"strings"
 )
 
-// Dockerfile assembles a Dockerfile from a recipe graph.
-func Dockerfile(ctx context.Context, base string, grp graph.RecipeIndex) (string, error) {
-	var file strings.Builder
-	fmt.Fprintf(&file, "FROM %s\n", base)
-	err := grp.Traverse(ctx, graph.TraverseOnce(func(r runner.Installer) error {
+// Options configures the generated Dockerfile.
+type Options struct {
+	// Base is the image for the FROM clause.
+	Base string
+	// Guard skips installs whose check already passes in the image.
+	Guard bool
+	// Verify runs the check again after an install, failing the build if it doesn't pass.
+	Verify bool
+	// Layers groups recipes into layers.
+	Layers Layers
+	// Args are the names of build arguments to declare, so that scripts can use them.
+	Args []string
+	// Version is the version of nfy, recorded in the image's labels.
+	Version string
+	// From is the name of a previous image built by nfy to build on top of, instead of Base.
+	// Only recipes that changed since, or depend on one that did, are installed.
+	From string
+	// Previous describes the From image.
+	Previous *ImageInfo
+	// Record keeps building when a recipe fails, recording the result of each recipe in StatusFile instead.
+	// Recipes whose dependencies failed are skipped.
+	Record bool
+}
+
+// dockerfile accumulates a Dockerfile and the files it needs.
+type dockerfile struct {
+	ctx  *Context
+	opts Options
+	body strings.Builder
+	// copies are the COPY instructions for the scripts of the layer being written, which go before it.
+	copies strings.Builder
+	// scripts are the paths the layer's scripts are copied to, which it removes once they've run.
+	scripts []string
+	// deps are the dependencies each step's status depends on, if results are recorded.
+	deps map[string][]string
+	// cached is set once a RUN instruction mounts a cache.
+	cached bool
+	// depth is the dependency depth of each installed step, which decides what packages are installed together.
+	depth map[string]int
+}
+
+// Dockerfile assembles a Dockerfile, and the build context it needs, from a recipe graph.
+// The installers are selected by traversal the same way they are for local installs,
+// so the graph should prefer the installers suited to the base (see Preferences).
+func Dockerfile(ctx context.Context, grp graph.RecipeIndex, opts Options) (*Context, error) {
+	steps, err := grp.Plan(ctx, func(runner.Installer) error { return nil })
+	if err != nil {
+		return nil, fmt.Errorf("traverse failed: %w", err)
+	}
+
+	// Requirements are only probed for installers that weren't selected for the base, unless a step needs them.
+	probes := grp.Probes()
+	targets := make(map[string]bool)
+	for _, r := range grp {
+		if len(r.Installers) > 0 && !probes[r.Installers[0].Runner.FullName()] {
+			targets[r.Installers[0].Runner.FullName()] = true
+		}
+	}
+	// skipped are planned but not part of the image.
+	// Steps only local_only recipes need are still planned, so ordering is unaffected.
+	localOnly := localOnlySteps(steps, targets)
+	needed := make(map[string]bool)
+	for _, step := range steps {
+		for _, dep := range step.Deps {
+			needed[dep] = true
+		}
+	}
+	skipped := func(step graph.Step) bool {
+		name := step.FullName()
+		return step.Skip != "" || localOnly[name] || step.DependencyOnly() || (probes[name] && !needed[name])
+	}
+	var selected []graph.Step
+	for _, step := range steps {
+		if !skipped(step) {
+			selected = append(selected, step)
+		}
+	}
+
+	d := &dockerfile{ctx: &Context{}, opts: opts}
+	install := selected
+	if opts.From != "" {
+		fmt.Fprintf(&d.body, "FROM %s\n", opts.From)
+		rebuild := changedSteps(steps, opts.Previous, skipped)
+		install = nil
+		for _, step := range selected {
+			if rebuild[step.FullName()] {
+				install = append(install, step)
+			}
+		}
+		d.ctx.Removed = removedRecipes(selected, opts.Previous)
+	} else {
+		fmt.Fprintf(&d.body, "FROM %s\n", opts.Base)
+	}
+	for _, arg := range opts.Args {
+		fmt.Fprintf(&d.body, "ARG %s\n", arg)
+	}
+	if opts.Record {
+		d.deps = recordedDeps(steps, skipped)
+		fmt.Fprintf(&d.body, "RUN %s\n", d.recordInit())
+	}
+	d.depth = make(map[string]int, len(install))
+	for i, depth := range depths(install) {
+		d.depth[install[i].FullName()] = depth
+	}
+	layers := opts.Layers.group(install)
+	if opts.Layers == LayerPerRecipe && !opts.Record {
+		layers = packageLayers(install)
+	}
+	for _, layer := range layers {
+		d.layer(layer)
+	}
+	// The previous image's recipes are inherited, so every recipe is labelled.
+	d.labels(grp.Names(), selected)
+	d.ctx.Dockerfile = d.body.String()
+	if d.cached {
+		// Cache mounts need BuildKit's Dockerfile syntax, which must be selected before anything else.
+		d.ctx.Dockerfile = syntaxHeader + d.ctx.Dockerfile
+	}
+	return d.ctx, nil
+}
+
+// localOnlySteps returns the full names of the steps only local installs need:
+// local_only steps, and the dependencies that only they need.
+// targets, and steps that nothing depends on, are wanted in their own right, so they're kept.
+func localOnlySteps(steps []graph.Step, targets map[string]bool) map[string]bool {
+	dependents := make(map[string][]string)
+	for _, step := range steps {
+		for _, dep := range step.Deps {
+			dependents[dep] = append(dependents[dep], step.FullName())
+		}
+	}
+	localOnly := make(map[string]bool)
+	// Dependents come after their dependencies, so they're decided first.
+	for i := len(steps) - 1; i >= 0; i-- {
+		name := steps[i].FullName()
+		if steps[i].Recipe.LocalOnly {
+			localOnly[name] = true
+			continue
+		}
+		needed := targets[name] || len(dependents[name]) == 0
+		for _, dependent := range dependents[name] {
+			needed = needed || !localOnly[dependent]
+		}
+		localOnly[name] = !needed
+	}
+	return localOnly
+}
+
+// base returns the base image the installers were selected for.
+func (d *dockerfile) base() string {
+	if d.opts.Previous != nil && d.opts.Previous.Base != "" {
+		return d.opts.Previous.Base
+	}
+	return d.opts.Base
+}
+
+// changedSteps returns the full names of the steps that are new or changed since the previous image was built,
+// along with every step that depends on them.
+// Skipped steps aren't in the image, so they're only rebuilt for the sake of their dependents.
+func changedSteps(steps []graph.Step, previous *ImageInfo, skipped func(graph.Step) bool) map[string]bool {
+	rebuild := make(map[string]bool)
+	for _, step := range steps {
+		name := step.FullName()
+		if !skipped(step) && previous.Recipes[name] != RecipeHash(step) {
+			rebuild[name] = true
+			continue
+		}
+		for _, dep := range step.Deps {
+			if rebuild[dep] {
+				rebuild[name] = true
+				break
+			}
+		}
+	}
+	return rebuild
+}
+
+// removedRecipes returns the recipes in the previous image that are no longer planned.
+func removedRecipes(steps []graph.Step, previous *ImageInfo) []string {
+	planned := make(map[string]bool)
+	for _, step := range steps {
+		planned[step.FullName()] = true
+	}
+	var removed []string
+	for _, name := range previous.RecipeNames() {
+		if !planned[name] {
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// layer writes a RUN instruction that runs each of the steps.
+// Steps that install packages with the same manager at the same depth are installed with one command.
+func (d *dockerfile) layer(steps []graph.Step) {
+	// Each result is recorded separately, so packages are only installed together if they aren't recorded.
+	var batches map[int][]graph.Step
+	var batched map[int]bool
+	if !d.opts.Record {
+		batches, batched = batchPackages(steps, d.depth)
+	}
+	// Comments are kept with the command they describe, so later commands carry theirs into the RUN.
+	// The scripts of every command are copied first, so that nothing comes between a comment and its command.
+	var cmds, notes []string
+	var note strings.Builder
+	for i, step := range steps {
+		if batched[i] {
+			continue
+		}
+		r := step.Installer
 		if r.Recipe.Comment != "" {
-			fmt.Fprintf(&file, "# %s: %s\n", r.FullName(), r.Recipe.Comment)
+			fmt.Fprintf(&note, "# %s: %s\n", r.FullName(), sanitizeComment(r.Recipe.Comment))
 		}
-		if r.CheckOnly() {
-			fmt.Fprintf(&file, "# Ensure the %q dependency exists:\n", r.FullName())
-			fmt.Fprintf(&file, "RUN %s\n", r.Recipe.Check)
-			return nil
-		} else if ins := r.Recipe.Installers[0]; ins.Script != "" {
-			fmt.Fprintf(&file, "RUN %s\n", ins.Script)
+		var cmd string
+		if batch := batches[i]; len(batch) > 0 {
+			for _, other := range batch[1:] {
+				if other.Recipe.Comment != "" {
+					fmt.Fprintf(&note, "# %s: %s\n", other.FullName(), sanitizeComment(other.Recipe.Comment))
+				}
+			}
+			if len(batch) > 1 {
+				names := make([]string, len(batch))
+				for j, member := range batch {
+					names[j] = fmt.Sprintf("%q", member.FullName())
+				}
+				fmt.Fprintf(&note, "# Install the packages of %s together:\n", strings.Join(names, ", "))
+			}
+			cmd = d.installPackages(batch)
+		} else if r.CheckOnly() {
+			fmt.Fprintf(&note, "# Ensure the %q dependency exists:\n", r.FullName())
+			cmd = d.command(r, "check", r.Recipe.Check)
+		} else if r.Script != "" {
+			cmd = d.install(r)
 		}
-		return nil
-	}))
-	if err != nil {
-		return "", fmt.Errorf("traverse failed: %w", err)
+		if d.opts.Record {
+			cmd = d.record(step, d.deps[r.FullName()], cmd)
+		}
+		if cmd != "" {
+			notes = append(notes, note.String())
+			note.Reset()
+			cmds = append(cmds, cmd)
+		}
+	}
+	d.body.WriteString(d.copies.String())
+	d.copies.Reset()
+	// Comments of steps without a command describe no part of the RUN.
+	d.body.WriteString(note.String())
+
+	if len(cmds) == 0 {
+		return
+	}
+	mounts := d.mounts(steps)
+	d.body.WriteString(notes[0])
+	if len(cmds) == 1 {
+		fmt.Fprintf(&d.body, "RUN %s%s", mounts, cmds[0])
+	} else {
+		// Subshells keep the steps as isolated from each other as they'd be in separate layers.
+		// Docker drops comment lines within an instruction, so each command is still described where it runs.
+		fmt.Fprintf(&d.body, "RUN %s(%s)", mounts, cmds[0])
+		for i, cmd := range cmds[1:] {
+			fmt.Fprintf(&d.body, " \\\n%s && (%s)", notes[i+1], cmd)
+		}
+	}
+	// Scripts are removed so that they don't linger in the image. The COPY layers before still hold them.
+	if len(d.scripts) > 0 {
+		fmt.Fprintf(&d.body, " \\\n && rm -f %s", strings.Join(d.scripts, " "))
+		d.scripts = nil
+	}
+	d.body.WriteString("\n")
+}
+
+// install returns the command that installs r, guarding and verifying it with the check if requested.
+func (d *dockerfile) install(r runner.Installer) string {
+	install := d.command(r, "install", r.Script)
+	if r.Recipe.Check == "" || (!d.opts.Guard && !d.opts.Verify) {
+		return install
+	}
+
+	check := d.command(r, "check", r.Recipe.Check)
+	switch {
+	case d.opts.Guard && d.opts.Verify:
+		return fmt.Sprintf("(%s) >/dev/null 2>&1 || { (%s) && (%s); }", check, install, check)
+	case d.opts.Guard:
+		return fmt.Sprintf("(%s) >/dev/null 2>&1 || (%s)", check, install)
+	default:
+		return fmt.Sprintf("(%s) && (%s)", install, check)
 	}
-	return file.String(), nil
 }
@@ -0,0 +1,225 @@
+package builder
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// renderContext renders the Dockerfile followed by the other files of the context, so that a single golden file
+// covers the whole context.
+func renderContext(c *Context) string {
+	var s strings.Builder
+	s.WriteString(c.Dockerfile)
+	var paths []string
+	for path := range c.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(&s, "\n# ==> %s <==\n%s", path, c.Files[path])
+	}
+	return s.String()
+}
+
+func TestDockerfile(t *testing.T) {
+	t.Parallel()
+
+	ubuntu := Options{Base: "ubuntu"}
+	// targets selects some of the recipes of a case's config, rather than all of them.
+	targets := map[string][]string{
+		"local_only_deps": {"fonts", "wget"},
+		// fontconfig is wanted for itself, not only for the local_only fonts.
+		"local_only_deps_targeted": {"fonts", "fontconfig", "wget"},
+	}
+	for _, tc := range []struct {
+		// name is also the name of the golden file.
+		name   string
+		config string
+		opts   Options
+	}{
+		{"basic", "basic.yml", ubuntu},
+		{"advanced", "advanced.yml", ubuntu},
+		{"overloaded", "overloaded.yml", ubuntu},
+		{"local_only", "local_only.yml", ubuntu},
+		{"local_only_deps", "local_only_deps.yml", ubuntu},
+		{"local_only_deps_targeted", "local_only_deps.yml", ubuntu},
+		{"multiline", "multiline.yml", ubuntu},
+		{"multiline_single", "multiline.yml", Options{Base: "ubuntu", Layers: 1}},
+		{"guarded", "advanced.yml", Options{Base: "ubuntu", Guard: true}},
+		{"verified", "advanced.yml", Options{Base: "ubuntu", Verify: true}},
+		{"guarded_verified", "multiline.yml", Options{Base: "ubuntu", Guard: true, Verify: true}},
+		{"toolchains", "toolchains.yml", ubuntu},
+		{"toolchains_depth", "toolchains.yml", Options{Base: "ubuntu", Layers: LayerPerDepth}},
+		{"toolchains_max2", "toolchains.yml", Options{Base: "ubuntu", Layers: 2}},
+		{"args", "basic.yml", Options{Base: "ubuntu", Args: []string{"HTTP_PROXY", "GOPROXY"}}},
+		{"recorded", "advanced.yml", Options{Base: "ubuntu", Record: true}},
+		{"cached", "cached.yml", ubuntu},
+		{"cached_single", "cached.yml", Options{Base: "ubuntu:22.04", Layers: 1}},
+		{"packages", "packages.yml", ubuntu},
+		{"packages_depth", "packages.yml", Options{Base: "ubuntu", Layers: LayerPerDepth}},
+		{"packages_guarded_verified", "packages.yml", Options{Base: "ubuntu", Guard: true, Verify: true}},
+		{"packages_recorded", "packages.yml", Options{Base: "ubuntu", Record: true}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var res parse.Result
+			err := parse.Traverse(&res, filepath.Join("testdata", tc.config))
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			grp, err := graph.Generate(runner.FromParseRecipes(res.Recipes, ""), graph.RemoteConfig{})
+			if err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+			if targets[tc.name] != nil {
+				selected := make(graph.RecipeIndex)
+				for _, target := range targets[tc.name] {
+					selected[target] = grp[target]
+				}
+				grp = selected
+			}
+			grp = grp.Prefer(Preferences(tc.opts.Base, res.BuildPrefer))
+
+			dctx, err := Dockerfile(context.Background(), grp, tc.opts)
+			if err != nil {
+				t.Fatalf("dockerfile: %v", err)
+			}
+			got := renderContext(dctx)
+
+			golden := filepath.Join("testdata", tc.name+".Dockerfile")
+			if *update {
+				err = ioutil.WriteFile(golden, []byte(got), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("read golden file (run with -update to create it): %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("Dockerfile differs from %s:\n%s", golden, cmp.Diff(string(want), got))
+			}
+
+			// Map iteration order must not affect the output.
+			for i := 0; i < 20; i++ {
+				again, err := Dockerfile(context.Background(), grp, tc.opts)
+				if err != nil {
+					t.Fatalf("dockerfile: %v", err)
+				}
+				if renderContext(again) != got {
+					t.Fatalf("Dockerfile is not deterministic:\n%s", cmp.Diff(got, renderContext(again)))
+				}
+			}
+		})
+	}
+}
+
+var labelPair = regexp.MustCompile(`"([^"]+)"="([^"]*)"`)
+
+// dockerfileLabels extracts the labels from a generated Dockerfile.
+func dockerfileLabels(dockerfile string) map[string]string {
+	labels := make(map[string]string)
+	for _, m := range labelPair.FindAllStringSubmatch(dockerfile, -1) {
+		labels[m[1]] = m[2]
+	}
+	return labels
+}
+
+func TestDockerfileFrom(t *testing.T) {
+	t.Parallel()
+
+	load := func(config string) graph.RecipeIndex {
+		res, err := parse.Parse(strings.NewReader(config))
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		grp, err := graph.Generate(runner.FromParseRecipes(res.Recipes, ""), graph.RemoteConfig{})
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		return grp
+	}
+
+	config, err := ioutil.ReadFile(filepath.Join("testdata", "toolchains.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := Dockerfile(context.Background(), load(string(config)), Options{Base: "ubuntu", Version: "v1"})
+	if err != nil {
+		t.Fatalf("dockerfile: %v", err)
+	}
+	previous, err := ParseLabels(dockerfileLabels(first.Dockerfile))
+	if err != nil {
+		t.Fatalf("parse labels: %v", err)
+	}
+
+	// Bump go and drop jq.
+	changed := strings.Replace(string(config), "go1.21.0", "go1.22.0", 1)
+	changed = changed[:strings.Index(changed, "jq:")]
+	dctx, err := Dockerfile(context.Background(), load(changed), Options{
+		Version:  "v1",
+		From:     "nfy-ubuntu:previous",
+		Previous: previous,
+	})
+	if err != nil {
+		t.Fatalf("dockerfile: %v", err)
+	}
+	t.Logf("Dockerfile:\n%s", dctx.Dockerfile)
+
+	if !strings.HasPrefix(dctx.Dockerfile, "FROM nfy-ubuntu:previous\n") {
+		t.Errorf("doesn't build on the previous image")
+	}
+	var runs []string
+	for _, line := range strings.Split(dctx.Dockerfile, "\n") {
+		if strings.HasPrefix(line, "RUN ") {
+			runs = append(runs, line)
+		}
+	}
+	want := []string{
+		"RUN curl -sSfL https://go.dev/dl/go1.22.0.linux-amd64.tar.gz | tar -C /usr/local -xz",
+		"RUN /usr/local/go/bin/go install golang.org/x/tools/gopls@latest",
+	}
+	if !cmp.Equal(runs, want) {
+		t.Errorf("expected only go and its dependents to be installed: %v", cmp.Diff(want, runs))
+	}
+	if !cmp.Equal(dctx.Removed, []string{"jq"}) {
+		t.Errorf("got removed %v, want [jq]", dctx.Removed)
+	}
+
+	// The image inherits the labels of the previous one, and overrides them.
+	inherited := dockerfileLabels(first.Dockerfile)
+	for k, v := range dockerfileLabels(dctx.Dockerfile) {
+		inherited[k] = v
+	}
+	labels, err := ParseLabels(inherited)
+	if err != nil {
+		t.Fatalf("parse labels: %v", err)
+	}
+	if _, ok := labels.Recipes["jq"]; ok {
+		t.Errorf("removed recipe jq is still labelled")
+	}
+	if labels.Base != "ubuntu" {
+		t.Errorf("got base %q, want the previous image's base", labels.Base)
+	}
+	if labels.Recipes["rustup"] != previous.Recipes["rustup"] || labels.Recipes["go"] == previous.Recipes["go"] {
+		t.Errorf("unexpected recipe hashes %+v", labels.Recipes)
+	}
+}
@@ -0,0 +1,120 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// Engine is a tool that builds images from a build context.
+type Engine string
+
+const (
+	Docker  Engine = "docker"
+	Podman  Engine = "podman"
+	Buildah Engine = "buildah"
+)
+
+// ParseEngine validates an engine name.
+func ParseEngine(s string) (Engine, error) {
+	switch e := Engine(s); e {
+	case Docker, Podman, Buildah:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unknown engine %q, expected docker, podman or buildah", s)
+	}
+}
+
+// BuildOptions are passed through to the engine.
+type BuildOptions struct {
+	// Image is the name to tag the image with.
+	Image string
+	// BuildArgs are KEY=VALUE pairs.
+	BuildArgs []string
+	NoCache   bool
+	Platform  string
+	// Labels are KEY=VALUE pairs.
+	Labels []string
+}
+
+// Args returns the arguments that build the context in dir.
+func (e Engine) Args(dir string, opts BuildOptions) []string {
+	args := []string{"build"}
+	if e == Buildah {
+		// bud is supported by every version of buildah, unlike its build alias.
+		args = []string{"bud"}
+	}
+	if opts.Image != "" {
+		args = append(args, "-t", opts.Image)
+	}
+	for _, arg := range opts.BuildArgs {
+		args = append(args, "--build-arg", arg)
+	}
+	if opts.NoCache {
+		args = append(args, "--no-cache")
+	}
+	if opts.Platform != "" {
+		args = append(args, "--platform", opts.Platform)
+	}
+	for _, label := range opts.Labels {
+		args = append(args, "--label", label)
+	}
+	return append(args, dir)
+}
+
+// Command returns a command that builds the context in dir.
+func (e Engine) Command(ctx context.Context, dir string, opts BuildOptions) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, string(e), e.Args(".", opts)...)
+	cmd.Dir = dir
+	return cmd
+}
+
+// InspectLabels returns the labels of a local image.
+func (e Engine) InspectLabels(ctx context.Context, image string) (map[string]string, error) {
+	args := []string{"image", "inspect", "--format", "{{json .Config.Labels}}", image}
+	if e == Buildah {
+		args = []string{"inspect", "--type", "image", "--format", "{{json .OCIv1.Config.Labels}}", image}
+	}
+	out, err := exec.CommandContext(ctx, string(e), args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("%v inspect %v: %w: %s", e, image, err, bytes.TrimSpace(exitErr.Stderr))
+		}
+		return nil, fmt.Errorf("%v inspect %v: %w", e, image, err)
+	}
+
+	var labels map[string]string
+	err = json.Unmarshal(out, &labels)
+	if err != nil {
+		return nil, fmt.Errorf("parse labels of %v: %w", image, err)
+	}
+	return labels, nil
+}
+
+// ReadFile returns the contents of a file in a local image.
+func (e Engine) ReadFile(ctx context.Context, image, path string) ([]byte, error) {
+	run := func(args ...string) ([]byte, error) {
+		out, err := exec.CommandContext(ctx, string(e), args...).Output()
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return nil, fmt.Errorf("%v %v: %w: %s", e, args[0], err, bytes.TrimSpace(exitErr.Stderr))
+			}
+			return nil, fmt.Errorf("%v %v: %w", e, args[0], err)
+		}
+		return out, nil
+	}
+
+	if e != Buildah {
+		return run("run", "--rm", "--entrypoint", "cat", image, path)
+	}
+	// Buildah runs commands in working containers.
+	ctr, err := run("from", "--pull-never", image)
+	if err != nil {
+		return nil, err
+	}
+	name := string(bytes.TrimSpace(ctr))
+	defer exec.Command(string(e), "rm", name).Run()
+	return run("run", name, "cat", path)
+}
@@ -0,0 +1,45 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEngineArgs(t *testing.T) {
+	t.Parallel()
+
+	opts := BuildOptions{
+		Image:     "nfy-ubuntu",
+		BuildArgs: []string{"HTTP_PROXY=http://proxy:3128"},
+		NoCache:   true,
+		Platform:  "linux/arm64",
+		Labels:    []string{"team=infra"},
+	}
+	for _, tc := range []struct {
+		engine Engine
+		opts   BuildOptions
+		want   []string
+	}{
+		{Docker, BuildOptions{Image: "nfy-ubuntu"}, []string{"build", "-t", "nfy-ubuntu", "."}},
+		{Podman, opts, []string{
+			"build", "-t", "nfy-ubuntu",
+			"--build-arg", "HTTP_PROXY=http://proxy:3128",
+			"--no-cache",
+			"--platform", "linux/arm64",
+			"--label", "team=infra",
+			".",
+		}},
+		{Buildah, BuildOptions{Image: "nfy-ubuntu", NoCache: true}, []string{"bud", "-t", "nfy-ubuntu", "--no-cache", "."}},
+	} {
+		got := tc.engine.Args(".", tc.opts)
+		if !cmp.Equal(got, tc.want) {
+			t.Errorf("%v: %v", tc.engine, cmp.Diff(tc.want, got))
+		}
+	}
+
+	_, err := ParseEngine("kaniko")
+	if err == nil {
+		t.Errorf("expected unknown engine to be rejected")
+	}
+}
@@ -0,0 +1,155 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/parse"
+)
+
+// Labels recorded on images built by nfy.
+const (
+	LabelVersion = "dev.nfy.version"
+	// LabelBase is the base image nfy built on, which decides installer preferences.
+	LabelBase = "dev.nfy.base"
+	// LabelTargets lists the targets the image was built with, separated by commas.
+	LabelTargets = "dev.nfy.targets"
+	// LabelRemotes lists the <repo>@<commit> of each remote dependency, separated by spaces.
+	LabelRemotes = "dev.nfy.remotes"
+	// LabelRecipePrefix is followed by the full name of a recipe. The label's value is the recipe's hash,
+	// or empty if the recipe was removed by a build on top of the image.
+	LabelRecipePrefix = "dev.nfy.recipe."
+)
+
+// RecipeHash identifies the contents of the step, so that changes to it can be detected.
+// It covers everything that decides the step's RUN instruction. Fields that are usually unset are left out when
+// they are, so that adding one doesn't change the hashes of every existing recipe.
+func RecipeHash(step graph.Step) string {
+	b, err := json.Marshal(struct {
+		Name          string
+		Installer     string
+		Check         string
+		Script        string
+		Comment       string
+		Revision      string
+		Deps          []string   `json:",omitempty"`
+		BuildOnly     bool       `json:",omitempty"`
+		LocalOnly     bool       `json:",omitempty"`
+		CacheDirs     []string   `json:",omitempty"`
+		When          parse.When `json:",omitempty"`
+		InstallerWhen parse.When `json:",omitempty"`
+		Manager       string     `json:",omitempty"`
+		Packages      []string   `json:",omitempty"`
+	}{
+		Name:          step.FullName(),
+		Installer:     step.Name,
+		Check:         step.Recipe.Check,
+		Script:        step.Script,
+		Comment:       step.Recipe.Comment,
+		Revision:      step.Revision,
+		Deps:          step.Deps,
+		BuildOnly:     step.Recipe.BuildOnly,
+		LocalOnly:     step.Recipe.LocalOnly,
+		CacheDirs:     step.Recipe.CacheDirs,
+		When:          step.Recipe.When,
+		InstallerWhen: step.When,
+		Manager:       step.Manager,
+		Packages:      step.Packages,
+	})
+	if err != nil {
+		// Marshalling strings can't fail.
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// quote quotes s for use in a LABEL instruction.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// labels writes a LABEL instruction describing the steps.
+// It belongs at the end of the Dockerfile so that the layers before it are cached independently of it.
+func (d *dockerfile) labels(targets []string, steps []graph.Step) {
+	var remotes []string
+	seen := make(map[string]bool)
+	for _, step := range steps {
+		if step.Revision != "" && !seen[step.Revision] {
+			seen[step.Revision] = true
+			remotes = append(remotes, step.Revision)
+		}
+	}
+
+	pairs := [][2]string{
+		{LabelVersion, d.opts.Version},
+		{LabelBase, d.base()},
+		{LabelTargets, strings.Join(targets, ",")},
+	}
+	// Labels are inherited from the previous image, so the ones that no longer apply are cleared.
+	previous := d.opts.Previous
+	if len(remotes) > 0 || (previous != nil && len(previous.Remotes) > 0) {
+		pairs = append(pairs, [2]string{LabelRemotes, strings.Join(remotes, " ")})
+	}
+	for _, step := range steps {
+		pairs = append(pairs, [2]string{LabelRecipePrefix + step.FullName(), RecipeHash(step)})
+	}
+	for _, name := range d.ctx.Removed {
+		pairs = append(pairs, [2]string{LabelRecipePrefix + name, ""})
+	}
+
+	d.body.WriteString("LABEL")
+	for _, pair := range pairs {
+		fmt.Fprintf(&d.body, " \\\n      %s=%s", quote(pair[0]), quote(pair[1]))
+	}
+	d.body.WriteString("\n")
+}
+
+// ImageInfo is what an image's labels say about how nfy built it.
+type ImageInfo struct {
+	Version string
+	Base    string
+	Targets []string
+	Remotes []string
+	// Recipes maps full recipe names to their hashes.
+	Recipes map[string]string
+}
+
+// ParseLabels reads the labels written by Dockerfile. It returns an error if the image wasn't built by nfy.
+func ParseLabels(labels map[string]string) (*ImageInfo, error) {
+	version, ok := labels[LabelVersion]
+	if !ok {
+		return nil, fmt.Errorf("image has no %v label, was it built by nfy?", LabelVersion)
+	}
+	info := &ImageInfo{
+		Version: version,
+		Base:    labels[LabelBase],
+		Recipes: make(map[string]string),
+	}
+	if targets := labels[LabelTargets]; targets != "" {
+		info.Targets = strings.Split(targets, ",")
+	}
+	info.Remotes = strings.Fields(labels[LabelRemotes])
+	for k, v := range labels {
+		// Recipes removed since an earlier build have empty labels.
+		if strings.HasPrefix(k, LabelRecipePrefix) && v != "" {
+			info.Recipes[strings.TrimPrefix(k, LabelRecipePrefix)] = v
+		}
+	}
+	return info, nil
+}
+
+// RecipeNames returns the names of the recorded recipes in a stable order.
+func (i *ImageInfo) RecipeNames() []string {
+	var names []string
+	for name := range i.Recipes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
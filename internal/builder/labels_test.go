@@ -0,0 +1,85 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+func TestParseLabels(t *testing.T) {
+	t.Parallel()
+
+	info, err := ParseLabels(map[string]string{
+		LabelVersion:                      "v0.1.0",
+		LabelTargets:                      "htop,wget",
+		LabelRemotes:                      "github.com/ammario/dotfiles@0123abc",
+		LabelRecipePrefix + "htop":        "sha256:aa",
+		LabelRecipePrefix + "apt-get":     "sha256:bb",
+		"org.opencontainers.image.source": "https://github.com/coder/nfy",
+	})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := &ImageInfo{
+		Version: "v0.1.0",
+		Targets: []string{"htop", "wget"},
+		Remotes: []string{"github.com/ammario/dotfiles@0123abc"},
+		Recipes: map[string]string{
+			"htop":    "sha256:aa",
+			"apt-get": "sha256:bb",
+		},
+	}
+	if !cmp.Equal(info, want) {
+		t.Error(cmp.Diff(want, info))
+	}
+	if !cmp.Equal(info.RecipeNames(), []string{"apt-get", "htop"}) {
+		t.Errorf("unexpected order %v", info.RecipeNames())
+	}
+
+	_, err = ParseLabels(map[string]string{"maintainer": "someone"})
+	if err == nil {
+		t.Error("expected an error for an image not built by nfy")
+	}
+}
+
+// TestRecipeHash checks that changing anything that decides a step's RUN instruction changes its hash.
+func TestRecipeHash(t *testing.T) {
+	t.Parallel()
+
+	base := func() graph.Step {
+		return graph.Step{
+			Installer: runner.Installer{
+				Recipe:    parse.Recipe{Name: "htop", Check: "htop -h"},
+				Installer: parse.Installer{Name: "apt", Script: "apt-get install -y htop"},
+			},
+			Deps: []string{"apt"},
+		}
+	}
+	hash := RecipeHash(base())
+	if hash != RecipeHash(base()) {
+		t.Fatal("the hash isn't stable")
+	}
+
+	for name, change := range map[string]func(*graph.Step){
+		"Script":        func(s *graph.Step) { s.Script = "apt-get install -y --no-install-recommends htop" },
+		"Check":         func(s *graph.Step) { s.Recipe.Check = "command -v htop" },
+		"Deps":          func(s *graph.Step) { s.Deps = []string{"apt", "apt-update"} },
+		"BuildOnly":     func(s *graph.Step) { s.Recipe.BuildOnly = true },
+		"LocalOnly":     func(s *graph.Step) { s.Recipe.LocalOnly = true },
+		"CacheDirs":     func(s *graph.Step) { s.Recipe.CacheDirs = []string{"/var/cache/apt"} },
+		"When":          func(s *graph.Step) { s.Recipe.When = parse.When{"os": {"linux"}} },
+		"InstallerWhen": func(s *graph.Step) { s.When = parse.When{"arch": {"amd64"}} },
+		"Manager":       func(s *graph.Step) { s.Manager = "apt" },
+		"Packages":      func(s *graph.Step) { s.Packages = []string{"htop", "wget"} },
+	} {
+		step := base()
+		change(&step)
+		if RecipeHash(step) == hash {
+			t.Errorf("changing %v doesn't change the hash", name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package builder
+
+import (
+	"fmt"
+	"strconv"
+
+	"cdr.dev/nfy/internal/graph"
+)
+
+// Layers is the strategy for grouping recipes into RUN instructions, and therefore image layers.
+// A positive value is the maximum number of layers.
+type Layers int
+
+const (
+	// LayerPerRecipe runs each recipe in its own layer.
+	LayerPerRecipe Layers = 0
+	// LayerPerDepth runs all recipes with the same dependency depth in one layer.
+	LayerPerDepth Layers = -1
+)
+
+// ParseLayers parses "recipe", "depth" or a maximum number of layers.
+func ParseLayers(s string) (Layers, error) {
+	switch s {
+	case "", "recipe":
+		return LayerPerRecipe, nil
+	case "depth":
+		return LayerPerDepth, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("layers must be \"recipe\", \"depth\" or a positive number, got %q", s)
+	}
+	return Layers(n), nil
+}
+
+// depths returns the dependency depth of each step. Steps without dependencies have a depth of 0.
+// Every step must come after the steps it depends on.
+func depths(steps []graph.Step) []int {
+	byName := make(map[string]int, len(steps))
+	ds := make([]int, len(steps))
+	for i, step := range steps {
+		for _, dep := range step.Deps {
+			if d, ok := byName[dep]; ok && d+1 > ds[i] {
+				ds[i] = d + 1
+			}
+		}
+		byName[step.FullName()] = ds[i]
+	}
+	return ds
+}
+
+// group arranges steps into layers.
+// Layers other than LayerPerRecipe are ordered by depth, so rarely changing dependencies end up in early layers
+// and stay cached when the recipes that build on them change.
+func (l Layers) group(steps []graph.Step) [][]graph.Step {
+	if l == LayerPerRecipe {
+		layers := make([][]graph.Step, len(steps))
+		for i, step := range steps {
+			layers[i] = []graph.Step{step}
+		}
+		return layers
+	}
+
+	ds := depths(steps)
+	var levels [][]graph.Step
+	for i, step := range steps {
+		for len(levels) <= ds[i] {
+			levels = append(levels, nil)
+		}
+		levels[ds[i]] = append(levels[ds[i]], step)
+	}
+	// Steps may be filtered out after planning, leaving gaps.
+	var compact [][]graph.Step
+	for _, level := range levels {
+		if len(level) > 0 {
+			compact = append(compact, level)
+		}
+	}
+	levels = compact
+
+	if l == LayerPerDepth || len(levels) <= int(l) {
+		return levels
+	}
+	return mergeLevels(levels, int(l))
+}
+
+// mergeLevels merges adjacent levels into n layers of roughly the same number of steps.
+func mergeLevels(levels [][]graph.Step, n int) [][]graph.Step {
+	remaining := 0
+	for _, level := range levels {
+		remaining += len(level)
+	}
+
+	var layers [][]graph.Step
+	var layer []graph.Step
+	for i, level := range levels {
+		layer = append(layer, level...)
+		remaining -= len(level)
+		buckets := n - len(layers) - 1
+		levelsLeft := len(levels) - i - 1
+		// Close the layer once it has its share, or when every remaining level needs its own layer.
+		full := len(layer) >= (len(layer)+remaining)/(buckets+1)
+		if buckets > 0 && levelsLeft > 0 && (full || levelsLeft <= buckets) {
+			layers = append(layers, layer)
+			layer = nil
+		}
+	}
+	return append(layers, layer)
+}
@@ -0,0 +1,107 @@
+package builder
+
+import (
+	"fmt"
+	"strconv"
+
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/packages"
+)
+
+// packageKey identifies the steps that can install their packages together:
+// those using the same manager at the same dependency depth, which can't depend on each other.
+// It's empty for steps that don't install packages.
+func packageKey(step graph.Step, depth int) string {
+	if _, ok := packages.Lookup(step.Manager); !ok || step.Script == "" {
+		return ""
+	}
+	return step.Manager + "@" + strconv.Itoa(depth)
+}
+
+// batchPackages groups the steps of a layer that can install their packages together.
+// It returns the batch starting at each index, and the indexes of the steps that are part of an earlier batch.
+func batchPackages(steps []graph.Step, depth map[string]int) (map[int][]graph.Step, map[int]bool) {
+	batches := make(map[int][]graph.Step)
+	batched := make(map[int]bool)
+	first := make(map[string]int)
+	for i, step := range steps {
+		key := packageKey(step, depth[step.FullName()])
+		if key == "" {
+			continue
+		}
+		if j, ok := first[key]; ok {
+			batches[j] = append(batches[j], step)
+			batched[i] = true
+			continue
+		}
+		first[key] = i
+		batches[i] = []graph.Step{step}
+	}
+	return batches, batched
+}
+
+// installPackages returns the command that installs the packages of every step with a single run of their manager.
+func (d *dockerfile) installPackages(steps []graph.Step) string {
+	m, _ := packages.Lookup(steps[0].Manager)
+	lists := make([][]string, len(steps))
+	for i, step := range steps {
+		lists[i] = step.Packages
+	}
+	pkgs := packages.Merge(lists...)
+
+	install := m.Install(pkgs)
+	if d.opts.Guard {
+		install = m.InstallMissing(pkgs)
+	}
+	if d.opts.Verify {
+		return fmt.Sprintf("(%s) && (%s)", install, m.Check(pkgs))
+	}
+	return install
+}
+
+// packageLayers puts each step in its own layer, like LayerPerRecipe,
+// except that steps that can install their packages together share one.
+// The layers keep the planned order, except that a batch waits for the dependencies of all of its steps.
+func packageLayers(steps []graph.Step) [][]graph.Step {
+	ds := depths(steps)
+	var units [][]graph.Step
+	unitOf := make(map[string]int, len(steps))
+	byKey := make(map[string]int)
+	for i, step := range steps {
+		key := packageKey(step, ds[i])
+		u, ok := byKey[key]
+		if key == "" || !ok {
+			u = len(units)
+			units = append(units, nil)
+			if key != "" {
+				byKey[key] = u
+			}
+		}
+		units[u] = append(units[u], step)
+		unitOf[step.FullName()] = u
+	}
+
+	// Steps in a batch have the same depth, so they can't depend on each other through other units.
+	placed := make([]bool, len(units))
+	ready := func(u int) bool {
+		for _, step := range units[u] {
+			for _, dep := range step.Deps {
+				if v, ok := unitOf[dep]; ok && v != u && !placed[v] {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	layers := make([][]graph.Step, 0, len(units))
+	for len(layers) < len(units) {
+		for u := range units {
+			if !placed[u] && ready(u) {
+				placed[u] = true
+				layers = append(layers, units[u])
+				break
+			}
+		}
+	}
+	return layers
+}
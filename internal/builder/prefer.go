@@ -0,0 +1,25 @@
+package builder
+
+import "strings"
+
+// Preferences returns the installers preferred for base, given a config that maps base images to installers.
+// A base matches a key if they're equal or if the key names the base's repository without a tag or digest,
+// so "ubuntu" matches "ubuntu:22.04". Preferences that apply to every base (the empty key) come last.
+func Preferences(base string, config map[string][]string) []string {
+	repo := base
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo = repo[:i]
+	}
+	// A colon after the last slash separates the tag, a colon before it is a registry port.
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+
+	var prefs []string
+	if names, ok := config[base]; ok {
+		prefs = append(prefs, names...)
+	} else if names, ok := config[repo]; ok {
+		prefs = append(prefs, names...)
+	}
+	return append(prefs, config[""]...)
+}
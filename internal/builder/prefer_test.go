@@ -0,0 +1,34 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPreferences(t *testing.T) {
+	t.Parallel()
+
+	config := map[string][]string{
+		"":                    {"curl"},
+		"ubuntu":              {"apt"},
+		"ubuntu:18.04":        {"apt-legacy"},
+		"localhost:5000/arch": {"pacman"},
+	}
+	for _, tc := range []struct {
+		base string
+		want []string
+	}{
+		{"ubuntu", []string{"apt", "curl"}},
+		{"ubuntu:22.04", []string{"apt", "curl"}},
+		{"ubuntu:18.04", []string{"apt-legacy", "curl"}},
+		{"ubuntu@sha256:abc", []string{"apt", "curl"}},
+		{"localhost:5000/arch:latest", []string{"pacman", "curl"}},
+		{"alpine", []string{"curl"}},
+	} {
+		got := Preferences(tc.base, config)
+		if !cmp.Equal(got, tc.want) {
+			t.Errorf("%v: %v", tc.base, cmp.Diff(tc.want, got))
+		}
+	}
+}
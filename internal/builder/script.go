@@ -0,0 +1,59 @@
+package builder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"cdr.dev/nfy/internal/runner"
+)
+
+const (
+	// contextScriptDir is where scripts are kept in the build context.
+	contextScriptDir = "nfy"
+	// imageScriptDir is where scripts are copied to in the image.
+	imageScriptDir = "/tmp/nfy"
+)
+
+// inlineable returns whether a RUN instruction can hold the script as is.
+// Scripts spanning multiple lines would be cut off, and scripts that look like a JSON array would be
+// mistaken for the exec form of RUN.
+func inlineable(script string) bool {
+	return !strings.ContainsAny(script, "\r\n") && !strings.HasPrefix(script, "[")
+}
+
+// sanitizeComment collapses s onto a single line so that it can follow a "#".
+func sanitizeComment(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^\w.-]+`)
+
+// scriptName returns a name for the script of an installer phase that is safe to use as a file name.
+func scriptName(r runner.Installer, phase string) string {
+	name := r.FullName()
+	if r.Name != "" {
+		name += "." + r.Name
+	}
+	return unsafeFileChars.ReplaceAllString(name, "_") + "." + phase
+}
+
+// command returns a shell command that runs script.
+// If RUN can't hold the script directly, it's added to the build context and COPY'd into the image before the layer,
+// whose RUN removes it again.
+func (d *dockerfile) command(r runner.Installer, phase, script string) string {
+	script = strings.TrimSpace(script)
+	if inlineable(script) {
+		return script
+	}
+
+	base := scriptName(r, phase)
+	name := base + ".sh"
+	for i := 2; d.ctx.Files[contextScriptDir+"/"+name] != nil; i++ {
+		name = fmt.Sprintf("%s-%d.sh", base, i)
+	}
+	d.ctx.addFile(contextScriptDir+"/"+name, []byte(script+"\n"))
+	fmt.Fprintf(&d.copies, "COPY %s/%s %s/%s\n", contextScriptDir, name, imageScriptDir, name)
+	d.scripts = append(d.scripts, imageScriptDir+"/"+name)
+	return fmt.Sprintf("sh %s/%s", imageScriptDir, name)
+}
@@ -0,0 +1,139 @@
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"cdr.dev/nfy/internal/graph"
+)
+
+// StatusFile is where images built with Options.Record keep the result of each recipe.
+// Each line is a status followed by the full name of a recipe.
+const StatusFile = "/var/lib/nfy/status"
+
+// Status is the result of a recipe in an image built with Options.Record.
+type Status string
+
+const (
+	StatusOK     Status = "ok"
+	StatusFailed Status = "failed"
+	// StatusSkipped means a dependency of the recipe failed or was skipped.
+	StatusSkipped Status = "skipped"
+)
+
+// ParseStatus parses the contents of a StatusFile into the status of each recipe.
+// Later lines take precedence over earlier ones.
+func ParseStatus(b []byte) (map[string]Status, error) {
+	status := make(map[string]Status)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed status line %q", line)
+		}
+		switch s := Status(fields[0]); s {
+		case StatusOK, StatusFailed, StatusSkipped:
+			status[fields[1]] = s
+		default:
+			return nil, fmt.Errorf("unknown status %q for %v", s, fields[1])
+		}
+	}
+	return status, sc.Err()
+}
+
+// shellQuote quotes s as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// recordInit returns the command that prepares the status file.
+// Images built on a previous one keep its statuses, since its recipes aren't all installed again.
+func (d *dockerfile) recordInit() string {
+	dir := StatusFile[:strings.LastIndex(StatusFile, "/")]
+	if d.opts.From != "" {
+		return fmt.Sprintf("mkdir -p %s && touch %s", dir, StatusFile)
+	}
+	return fmt.Sprintf("mkdir -p %s && : > %s", dir, StatusFile)
+}
+
+// record wraps cmd, which may be empty, so that it appends the step's status to the status file instead of failing.
+// cmd only runs if every dependency in deps succeeded.
+func (d *dockerfile) record(step graph.Step, deps []string, cmd string) string {
+	name := shellQuote(step.FullName())
+	body := fmt.Sprintf("echo ok %s >> %s", name, StatusFile)
+	if cmd != "" {
+		// Only the status is appended, the output of cmd goes to the build log.
+		body = fmt.Sprintf("if (%s); then echo ok %s >> %s; else echo failed %s >> %s; fi",
+			cmd, name, StatusFile, name, StatusFile,
+		)
+	}
+	if len(deps) == 0 {
+		return body
+	}
+
+	var conds []string
+	for _, dep := range deps {
+		conds = append(conds, fmt.Sprintf("grep -qxF %s %s", shellQuote("ok "+dep), StatusFile))
+	}
+	return fmt.Sprintf("if %s; then %s; else echo skipped %s >> %s; fi",
+		strings.Join(conds, " && "), body, name, StatusFile,
+	)
+}
+
+// recordedDeps returns, for each step, the dependencies whose status it depends on.
+// Steps that aren't part of the image have no status, so they're replaced by their own dependencies.
+func recordedDeps(steps []graph.Step, skipped func(graph.Step) bool) map[string][]string {
+	byName := make(map[string]graph.Step)
+	for _, step := range steps {
+		byName[step.FullName()] = step
+	}
+
+	deps := make(map[string][]string)
+	for _, step := range steps {
+		var (
+			resolved []string
+			seen     = make(map[string]bool)
+			resolve  func(names []string)
+		)
+		resolve = func(names []string) {
+			for _, name := range names {
+				if seen[name] {
+					continue
+				}
+				seen[name] = true
+				if dep, ok := byName[name]; ok && skipped(dep) {
+					resolve(dep.Deps)
+					continue
+				}
+				resolved = append(resolved, name)
+			}
+		}
+		resolve(step.Deps)
+		deps[step.FullName()] = resolved
+	}
+	return deps
+}
+
+var unsafeTagChars = regexp.MustCompile(`[^\w.-]+`)
+
+// BaseTag returns a name for base that can be used as an image tag or a file name.
+func BaseTag(base string) string {
+	return strings.Trim(unsafeTagChars.ReplaceAllString(base, "-"), "-.")
+}
+
+// ImageForBase returns the name of the image built on base, when building image on several bases.
+// The base becomes the tag, or is appended to the tag if image already has one.
+func ImageForBase(image, base string) string {
+	// A colon after the last slash separates the tag, a colon before it is a registry port.
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image + "-" + BaseTag(base)
+	}
+	return image + ":" + BaseTag(base)
+}
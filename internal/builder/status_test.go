@@ -0,0 +1,154 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+const recordedConfig = `
+present:
+  check: "true"
+missing:
+  check: "false"
+works:
+  install: "true"
+  deps:
+    - present
+broken:
+  install: "false"
+  deps:
+    - present
+noisy:
+  install: "echo installing noisy; echo warning >&2"
+  deps:
+    - present
+noisy_broken:
+  install: "echo breaking noisy; false"
+after_broken:
+  install: "true"
+  deps:
+    - works
+    - broken
+after_missing:
+  install: "true"
+  deps:
+    - missing
+local:
+  install: "false"
+  local_only: true
+after_local:
+  install: "true"
+  deps:
+    - local
+`
+
+// TestDockerfileRecord runs the RUN instructions of a recorded Dockerfile and checks the statuses they record.
+func TestDockerfileRecord(t *testing.T) {
+	t.Parallel()
+
+	res, err := parse.Parse(strings.NewReader(recordedConfig))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := graph.Generate(runner.FromParseRecipes(res.Recipes, ""), graph.RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	dctx, err := Dockerfile(context.Background(), grp, Options{Base: "ubuntu", Record: true})
+	if err != nil {
+		t.Fatalf("dockerfile: %v", err)
+	}
+	t.Logf("Dockerfile:\n%s", dctx.Dockerfile)
+
+	dir, err := ioutil.TempDir("", "nfy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	status := filepath.Join(dir, "status")
+
+	for _, line := range strings.Split(dctx.Dockerfile, "\n") {
+		if !strings.HasPrefix(line, "RUN ") {
+			continue
+		}
+		script := strings.NewReplacer(
+			StatusFile, status,
+			filepath.Dir(StatusFile), dir,
+		).Replace(strings.TrimPrefix(line, "RUN "))
+		out, err := exec.Command("sh", "-c", script).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v: %s", script, err, out)
+		}
+	}
+
+	b, err := ioutil.ReadFile(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseStatus(b)
+	if err != nil {
+		t.Fatalf("parse status: %v", err)
+	}
+	want := map[string]Status{
+		"present":       StatusOK,
+		"missing":       StatusFailed,
+		"works":         StatusOK,
+		"broken":        StatusFailed,
+		"noisy":         StatusOK,
+		"noisy_broken":  StatusFailed,
+		"after_broken":  StatusSkipped,
+		"after_missing": StatusSkipped,
+		"after_local":   StatusOK,
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("unexpected statuses: %v", cmp.Diff(want, got))
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	t.Parallel()
+
+	got, err := ParseStatus([]byte("failed go\nok go\nskipped remote/gopls\n\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := map[string]Status{"go": StatusOK, "remote/gopls": StatusSkipped}
+	if !cmp.Equal(got, want) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	for _, bad := range []string{"ok", "done go"} {
+		_, err = ParseStatus([]byte(bad))
+		if err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestImageForBase(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		image, base, want string
+	}{
+		{"dev", "ubuntu:22.04", "dev:ubuntu-22.04"},
+		{"dev:v2", "debian:12", "dev:v2-debian-12"},
+		{"localhost:5000/dev", "registry.fedoraproject.org/fedora:40", "localhost:5000/dev:registry.fedoraproject.org-fedora-40"},
+	} {
+		got := ImageForBase(tc.image, tc.base)
+		if got != tc.want {
+			t.Errorf("ImageForBase(%q, %q) = %q, want %q", tc.image, tc.base, got, tc.want)
+		}
+	}
+}
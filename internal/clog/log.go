@@ -2,36 +2,71 @@ package clog
 
 import (
 	"fmt"
-	"github.com/fatih/color"
+	"io"
 	"os"
+
+	"github.com/fatih/color"
 )
 
-func prnt(c color.Attribute, level string, msg string, args ...interface{}) {
-	color.New(c).Fprintf(os.Stderr, level+" ")
-	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+// Logger writes log lines to a writer.
+type Logger struct {
+	w io.Writer
 }
 
-func Debug(msg string, args ...interface{}) {
+// New returns a Logger that writes to w.
+func New(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// std is used by the package level functions.
+var std = New(os.Stderr)
+
+// prnt writes the entire line in a single call so that it isn't split by concurrent writers.
+func (l *Logger) prnt(c color.Attribute, level string, msg string, args ...interface{}) {
+	fmt.Fprint(l.w, color.New(c).Sprint(level)+" "+fmt.Sprintf(msg, args...)+"\n")
+}
+
+func (l *Logger) Debug(msg string, args ...interface{}) {
 	if os.Getenv("DEBUG") == "" {
 		return
 	}
-	prnt(color.FgWhite, "debug", msg, args...)
+	l.prnt(color.FgWhite, "debug", msg, args...)
+}
+
+func (l *Logger) Info(msg string, args ...interface{}) {
+	l.prnt(color.FgBlue, "info", msg, args...)
+}
+
+func (l *Logger) Success(msg string, args ...interface{}) {
+	l.prnt(color.FgGreen, "success", msg, args...)
+}
+
+func (l *Logger) Warn(msg string, args ...interface{}) {
+	l.prnt(color.FgYellow, "warn", msg, args...)
+}
+
+func (l *Logger) Error(msg string, args ...interface{}) {
+	l.prnt(color.FgRed, "error", msg, args...)
+}
+
+func Debug(msg string, args ...interface{}) {
+	std.Debug(msg, args...)
 }
 
 func Info(msg string, args ...interface{}) {
-	prnt(color.FgBlue, "info", msg, args...)
+	std.Info(msg, args...)
 }
 
 func Success(msg string, args ...interface{}) {
-	prnt(color.FgGreen, "success", msg, args...)
+	std.Success(msg, args...)
 }
 
 func Warn(msg string, args ...interface{}) {
-	prnt(color.FgYellow, "warn", msg, args...)
+	std.Warn(msg, args...)
 }
 
 func Error(msg string, args ...interface{}) {
-	prnt(color.FgRed, "error", msg, args...)
+	std.Error(msg, args...)
 }
 
 func Fatal(msg string, args ...interface{}) {
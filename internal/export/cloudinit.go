@@ -0,0 +1,36 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cdr.dev/nfy/internal/graph"
+)
+
+// cloudInitScript is where the script is written on the provisioned machine.
+const cloudInitScript = "/var/lib/nfy/apply.sh"
+
+// CloudInit produces a #cloud-config document that writes the Shell export to the machine and runs it.
+// Provisioning is treated like a container build, so build_only recipes run and local_only recipes don't,
+// regardless of opts.Build.
+func CloudInit(ctx context.Context, grp graph.RecipeIndex, opts Options) (string, error) {
+	opts.Build = true
+	script, err := Shell(ctx, grp, opts)
+	if err != nil {
+		return "", err
+	}
+
+	// The document is written by hand since YAML encoders quote the script rather than using a readable
+	// block scalar when it contains tabs.
+	var doc strings.Builder
+	doc.WriteString("#cloud-config\n")
+	doc.WriteString("write_files:\n")
+	fmt.Fprintf(&doc, "  - path: %s\n", cloudInitScript)
+	doc.WriteString("    permissions: \"0755\"\n")
+	doc.WriteString("    content: |\n")
+	doc.WriteString(indent(script, "      "))
+	doc.WriteString("runcmd:\n")
+	fmt.Fprintf(&doc, "  - [sh, %s]\n", cloudInitScript)
+	return doc.String(), nil
+}
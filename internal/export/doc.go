@@ -0,0 +1,2 @@
+// Package export converts a nfy config into formats that can be applied without nfy, such as a shell script.
+package export
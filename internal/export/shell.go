@@ -0,0 +1,330 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cdr.dev/nfy/internal/facts"
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/packages"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+// Options configures an export.
+type Options struct {
+	// Build applies the semantics of container builds rather than those of local installs:
+	// build_only recipes run and local_only recipes are skipped.
+	Build bool
+}
+
+func (o Options) skip(r runner.Installer) (string, bool) {
+	switch {
+	case o.Build && r.Recipe.LocalOnly:
+		return "local_only", true
+	case !o.Build && r.Recipe.BuildOnly:
+		return "build_only", true
+	}
+	return "", false
+}
+
+const shellHeader = `#!/bin/sh
+# Generated by nfy export.
+#
+# Each recipe runs in dependency order. A recipe whose check passes is left alone, otherwise
+# the first installer whose dependencies are satisfied is used.
+
+nfy_log() {
+	printf 'nfy: %s\n' "$*" >&2
+}
+
+nfy_fail() {
+	nfy_log "$*"
+	exit 1
+}
+`
+
+// Shell produces a POSIX shell script that applies the recipe graph.
+// Installers are selected when the script runs, in the same way nfy selects them.
+func Shell(ctx context.Context, grp graph.RecipeIndex, opts Options) (string, error) {
+	plan, err := grp.PlanAlternatives(ctx)
+	if err != nil {
+		return "", fmt.Errorf("traverse failed: %w", err)
+	}
+	// Requirements other recipes probe for aren't targets, even when every recipe in the index is.
+	probes := grp.Probes()
+	for i := range plan {
+		if probes[plan[i].Name] {
+			plan[i].Root = false
+		}
+	}
+
+	s := &shell{vars: make(map[string]string), taken: make(map[string]bool)}
+	s.body.WriteString(shellHeader)
+	if usesWhen(plan) {
+		s.body.WriteString("\n")
+		s.facts(opts)
+	}
+	for _, alts := range plan {
+		s.body.WriteString("\n")
+		err = s.recipe(alts, opts)
+		if err != nil {
+			return "", err
+		}
+	}
+	return s.body.String(), nil
+}
+
+type shell struct {
+	body strings.Builder
+	// vars maps full names of recipes to the variable that is set once they're satisfied.
+	vars  map[string]string
+	taken map[string]bool
+}
+
+var unsafeVarChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// okVar returns the variable that is set once the recipe is satisfied.
+func (s *shell) okVar(name string) string {
+	if v, ok := s.vars[name]; ok {
+		return v
+	}
+	base := "nfy_ok_" + unsafeVarChars.ReplaceAllString(name, "_")
+	v := base
+	for i := 2; s.taken[v]; i++ {
+		v = fmt.Sprintf("%s_%d", base, i)
+	}
+	s.vars[name] = v
+	s.taken[v] = true
+	return v
+}
+
+// condition returns a test for whether all of deps are satisfied.
+func (s *shell) condition(deps []string) string {
+	var tests []string
+	for _, dep := range deps {
+		tests = append(tests, fmt.Sprintf(`[ -n "$%s" ]`, s.okVar(dep)))
+	}
+	return strings.Join(tests, " && ")
+}
+
+// quiet wraps a check so that it runs in a subshell and its output is discarded.
+func quiet(check string) string {
+	check = strings.TrimSpace(check)
+	if strings.Contains(check, "\n") {
+		return subshell(check) + " >/dev/null 2>&1"
+	}
+	return "(" + check + ") >/dev/null 2>&1"
+}
+
+// subshell runs a script in a subshell, as nfy would with sh -c.
+// The script is written out verbatim rather than indented, since indenting would change heredocs.
+func subshell(script string) string {
+	return "(\n" + strings.TrimRight(script, "\n") + "\n\t)"
+}
+
+func indent(s, prefix string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s *shell) recipe(alts graph.Alternatives, opts Options) error {
+	first := alts.Steps[0].Installer
+	ok := s.okVar(alts.Name)
+	b := &s.body
+
+	fmt.Fprintf(b, "# %s", alts.Name)
+	if first.Recipe.Comment != "" {
+		fmt.Fprintf(b, ": %s", strings.Join(strings.Fields(first.Recipe.Comment), " "))
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(b, "%s=\n", ok)
+
+	if reason, skip := opts.skip(first); skip {
+		fmt.Fprintf(b, "%s=1 # %s\n", ok, reason)
+		return nil
+	}
+
+	// Recipes that are only dependencies may be unsatisfiable, as long as the installers needing them aren't used.
+	unsatisfied := "nfy_log"
+	if alts.Root {
+		unsatisfied = "nfy_fail"
+	}
+
+	var (
+		// opened is whether an if statement is open, braced whether a block is.
+		opened, braced bool
+		unconditional  bool
+	)
+	// keyword continues the if statement if one is open.
+	keyword := func() string {
+		if opened {
+			return "elif"
+		}
+		opened = true
+		return "if"
+	}
+
+	applies, err := when(first.Recipe.When, first.Recipe.Source)
+	if err != nil {
+		return err
+	}
+	if applies != "" {
+		// Recipes that don't apply count as satisfied, as they do for nfy install.
+		fmt.Fprintf(b, "if ! { %s; }; then\n\t%s=1 # does not apply\n", applies, ok)
+		opened = true
+	}
+
+	if first.CheckOnly() {
+		fmt.Fprintf(b, "%s %s; then\n\t%s=1\nelse\n\t%s %q\nfi\n",
+			keyword(), quiet(first.Recipe.Check), ok, unsatisfied, "requirement "+alts.Name+" is not met",
+		)
+		return nil
+	}
+
+	// Packages are checked by the installer of their manager, since each manager checks its own.
+	if first.Recipe.Check != "" && first.Manager == "" {
+		fmt.Fprintf(b, "%s %s; then\n\t%s=1\n", keyword(), quiet(first.Recipe.Check), ok)
+	}
+	for _, step := range alts.Steps {
+		cond := s.condition(step.Deps)
+		applies, err := when(step.When, step.Source)
+		if err != nil {
+			return err
+		}
+		if applies != "" {
+			if cond != "" {
+				cond += " && "
+			}
+			cond += applies
+		}
+		switch {
+		case cond == "" && opened:
+			b.WriteString("else\n")
+		case cond == "":
+			b.WriteString("{\n")
+			braced = true
+		case opened:
+			fmt.Fprintf(b, "elif %s; then\n", cond)
+		default:
+			fmt.Fprintf(b, "if %s; then\n", cond)
+			opened = true
+		}
+
+		if step.Script != "" {
+			script := step.Script
+			if m, ok := packages.Lookup(step.Manager); ok {
+				script = m.InstallMissing(step.Packages)
+			}
+			fqdn := step.FQDN(step.Recipe)
+			fmt.Fprintf(b, "\tnfy_log %q\n", "installing "+fqdn)
+			fmt.Fprintf(b, "\t%s || nfy_fail %q\n", subshell(script), "install of "+fqdn+" failed")
+		}
+		fmt.Fprintf(b, "\t%s=1\n", ok)
+		// Later installers can't be reached.
+		if cond == "" {
+			unconditional = true
+			break
+		}
+	}
+
+	switch {
+	case braced:
+		b.WriteString("}\n")
+	case unconditional:
+		b.WriteString("fi\n")
+	default:
+		fmt.Fprintf(b, "else\n\t%s %q\nfi\n", unsatisfied, "no usable installer for "+alts.Name)
+	}
+	return nil
+}
+
+func usesWhen(plan []graph.Alternatives) bool {
+	for _, alts := range plan {
+		for _, step := range alts.Steps {
+			if len(step.Recipe.When) > 0 || len(step.When) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// facts writes the detection of the system's facts, so that when conditions are evaluated where the script runs.
+func (s *shell) facts(opts Options) {
+	b := &s.body
+	b.WriteString("# Facts about the system, for when conditions.\n")
+	fmt.Fprintf(b, "nfy_facts=$(\n%s\n)\n", indent(strings.TrimSpace(facts.Script), "\t"))
+	b.WriteString(`nfy_fact() {
+	printf '%s\n' "$nfy_facts" | sed -n "s/^$1=//p"
+}
+`)
+	for _, name := range facts.Names {
+		if name == "build" {
+			fmt.Fprintf(b, "nfy_fact_build=%t\n", opts.Build)
+			continue
+		}
+		fmt.Fprintf(b, "nfy_fact_%s=$(nfy_fact %s)\n", name, name)
+	}
+	b.WriteString(`
+# nfy_match returns whether a word of the fact in $1 matches one of the patterns that follow.
+nfy_match() {
+	nfy_value=$1
+	shift
+	for nfy_word in $nfy_value; do
+		for nfy_pattern in "$@"; do
+			case $nfy_word in $nfy_pattern) return 0 ;; esac
+		done
+	done
+	return 1
+}
+`)
+}
+
+// when returns a test for whether the system matches a when condition, or an empty string if there's no condition.
+func when(w parse.When, source parse.Pos) (string, error) {
+	known := make(map[string]bool)
+	for _, name := range facts.Names {
+		known[name] = true
+	}
+	names := make([]string, 0, len(w))
+	for name := range w {
+		if !known[name] {
+			return "", parse.Errorf(source, "unknown fact %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tests []string
+	for _, name := range names {
+		var include, exclude []string
+		for _, pattern := range w[name] {
+			if strings.HasPrefix(pattern, "!") {
+				exclude = append(exclude, shellQuote(pattern[1:]))
+			} else {
+				include = append(include, shellQuote(pattern))
+			}
+		}
+		if len(include) > 0 {
+			tests = append(tests, fmt.Sprintf(`nfy_match "$nfy_fact_%s" %s`, name, strings.Join(include, " ")))
+		}
+		if len(exclude) > 0 {
+			tests = append(tests, fmt.Sprintf(`! nfy_match "$nfy_fact_%s" %s`, name, strings.Join(exclude, " ")))
+		}
+	}
+	return strings.Join(tests, " && "), nil
+}
+
+// shellQuote quotes s as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,353 @@
+package export
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+const testConfig = `
+pm-a:
+  check: "test -n \"$HAVE_A\""
+pm-b:
+  check: "test -n \"$HAVE_B\""
+tool:
+  check: "test -f \"$OUT/tool\""
+  install_a:
+    script: "echo a > \"$OUT/tool\""
+    deps:
+      - pm-a
+  install_b:
+    script: |
+      echo b > "$OUT/tool"
+      echo "it's b" >> "$OUT/log"
+    deps:
+      - pm-b
+needs-tool:
+  install: "cp \"$OUT/tool\" \"$OUT/needs-tool\""
+  deps:
+    - tool
+local:
+  install: "touch \"$OUT/local\""
+  local_only: true
+build:
+  install: "touch \"$OUT/build\""
+  build_only: true
+on-linux:
+  when:
+    os: linux
+  install: "touch \"$OUT/on-linux\""
+not-linux:
+  when:
+    os: "!linux"
+  install: "touch \"$OUT/not-linux\""
+after-not-linux:
+  install: "touch \"$OUT/after-not-linux\""
+  deps:
+    - not-linux
+by-arch:
+  install_none:
+    script: "echo none > \"$OUT/by-arch\""
+    when:
+      arch: "!*"
+  install_any:
+    script: "echo any > \"$OUT/by-arch\""
+    when:
+      arch: "*"
+heredoc:
+  check: |
+    grep -qx done <<EOF
+    $(cat "$OUT/heredoc" 2>/dev/null)
+    EOF
+  install: |
+    cat > "$OUT/heredoc" <<EOF
+    done
+    EOF
+tools:
+  packages:
+    brew: [htop, wget]
+`
+
+// fakeBrew stands in for brew, with htop already installed. Packages are installed by creating a file named after
+// them in $OUT, and each install is logged to $OUT/brew.log.
+const fakeBrew = `#!/bin/sh
+case "$1" in
+list) test "$3" = htop || test -e "$OUT/$3" ;;
+install) shift; echo "$*" >> "$OUT/brew.log"; for pkg; do touch "$OUT/$pkg"; done ;;
+esac
+`
+
+func testGraph(t *testing.T, targets ...string) graph.RecipeIndex {
+	res, err := parse.Parse(strings.NewReader(strings.TrimSpace(testConfig)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := graph.Generate(runner.FromParseRecipes(res.Recipes, ""), graph.RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if targets == nil {
+		return grp
+	}
+	filtered := make(graph.RecipeIndex)
+	for _, target := range targets {
+		filtered[target] = grp[target]
+	}
+	return filtered
+}
+
+// runScript runs script with the given environment and returns the files it created.
+func runScript(t *testing.T, script string, env ...string) (map[string]string, error) {
+	dir, err := ioutil.TempDir("", "nfy-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = append(os.Environ(), append(env, "OUT="+dir)...)
+	out, runErr := cmd.CombinedOutput()
+	t.Logf("output:\n%s", out)
+
+	files := make(map[string]string)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		b, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[info.Name()] = string(b)
+	}
+	return files, runErr
+}
+
+func TestShell(t *testing.T) {
+	t.Parallel()
+
+	t.Run("SelectsInstallerAtRuntime", func(t *testing.T) {
+		script, err := Shell(context.Background(), testGraph(t, "needs-tool"), Options{})
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+
+		files, err := runScript(t, script, "HAVE_B=1")
+		if err != nil {
+			t.Fatalf("script failed: %v", err)
+		}
+		if files["tool"] != "b\n" || files["needs-tool"] != "b\n" || files["log"] != "it's b\n" {
+			t.Errorf("unexpected files %+v", files)
+		}
+
+		files, err = runScript(t, script, "HAVE_A=1", "HAVE_B=1")
+		if err != nil {
+			t.Fatalf("script failed: %v", err)
+		}
+		if files["tool"] != "a\n" {
+			t.Errorf("expected the first installer, got files %+v", files)
+		}
+
+		_, err = runScript(t, script)
+		if err == nil {
+			t.Errorf("expected failure when no installer is usable")
+		}
+	})
+
+	t.Run("EvaluatesWhen", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("expects a linux system")
+		}
+		script, err := Shell(context.Background(), testGraph(t, "on-linux", "after-not-linux", "by-arch"), Options{})
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		files, err := runScript(t, script)
+		if err != nil {
+			t.Fatalf("script failed: %v", err)
+		}
+		want := map[string]string{"on-linux": "", "after-not-linux": "", "by-arch": "any\n"}
+		if !cmp.Equal(files, want) {
+			t.Errorf("unexpected files: %v", cmp.Diff(want, files))
+		}
+	})
+
+	t.Run("KeepsHeredocs", func(t *testing.T) {
+		script, err := Shell(context.Background(), testGraph(t, "heredoc"), Options{})
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		files, err := runScript(t, script)
+		if err != nil {
+			t.Fatalf("script failed: %v", err)
+		}
+		want := map[string]string{"heredoc": "done\n"}
+		if !cmp.Equal(files, want) {
+			t.Errorf("unexpected files: %v", cmp.Diff(want, files))
+		}
+	})
+
+	t.Run("ProbesWithoutTargets", func(t *testing.T) {
+		res, err := parse.Parse(strings.NewReader(`
+apt-get:
+  check: "test -n \"$HAVE_APT\""
+brew:
+  check: "test -n \"$HAVE_BREW\""
+homebrew:
+  deps:
+    - brew
+htop:
+  install_apt:
+    script: "touch \"$OUT/htop\""
+    deps:
+      - apt-get
+  install_brew:
+    script: "touch \"$OUT/htop\""
+    deps:
+      - homebrew
+`))
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		grp, err := graph.Generate(runner.FromParseRecipes(res.Recipes, ""), graph.RemoteConfig{})
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		script, err := Shell(context.Background(), grp, Options{})
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+
+		// brew and homebrew are only probed by htop, so them not being met isn't fatal.
+		files, err := runScript(t, script, "HAVE_APT=1")
+		if err != nil {
+			t.Fatalf("script failed: %v", err)
+		}
+		want := map[string]string{"htop": ""}
+		if !cmp.Equal(files, want) {
+			t.Errorf("unexpected files: %v", cmp.Diff(want, files))
+		}
+
+		_, err = runScript(t, script)
+		if err == nil {
+			t.Errorf("expected failure when no installer is usable")
+		}
+	})
+
+	t.Run("InstallsMissingPackages", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "nfy-brew")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		err = ioutil.WriteFile(filepath.Join(dir, "brew"), []byte(fakeBrew), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		script, err := Shell(context.Background(), testGraph(t, "tools"), Options{})
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		files, err := runScript(t, script, "PATH="+dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+		if err != nil {
+			t.Fatalf("script failed: %v", err)
+		}
+		want := map[string]string{"brew.log": "wget\n", "wget": ""}
+		if !cmp.Equal(files, want) {
+			t.Errorf("unexpected files: %v", cmp.Diff(want, files))
+		}
+	})
+
+	t.Run("SkipsByMode", func(t *testing.T) {
+		grp := testGraph(t, "local", "build")
+		for _, tc := range []struct {
+			opts Options
+			want string
+		}{
+			{Options{}, "local"},
+			{Options{Build: true}, "build"},
+		} {
+			script, err := Shell(context.Background(), grp, tc.opts)
+			if err != nil {
+				t.Fatalf("export: %v", err)
+			}
+			files, err := runScript(t, script)
+			if err != nil {
+				t.Fatalf("script failed: %v", err)
+			}
+			if len(files) != 1 || files[tc.want] != "" {
+				t.Errorf("with %+v, expected only %v, got %+v", tc.opts, tc.want, files)
+			}
+		}
+	})
+}
+
+func TestCloudInit(t *testing.T) {
+	t.Parallel()
+
+	grp := testGraph(t, "local", "build", "needs-tool", "heredoc")
+	doc, err := CloudInit(context.Background(), grp, Options{})
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if !strings.HasPrefix(doc, "#cloud-config\n") {
+		t.Fatalf("missing #cloud-config header:\n%s", doc)
+	}
+
+	var config struct {
+		WriteFiles []struct {
+			Path        string `yaml:"path"`
+			Permissions string `yaml:"permissions"`
+			Content     string `yaml:"content"`
+		} `yaml:"write_files"`
+		RunCmd [][]string `yaml:"runcmd"`
+	}
+	err = yaml.Unmarshal([]byte(doc), &config)
+	if err != nil {
+		t.Fatalf("unmarshal:\n%s\n%v", doc, err)
+	}
+	if len(config.WriteFiles) != 1 || len(config.RunCmd) != 1 {
+		t.Fatalf("unexpected config %+v", config)
+	}
+	if !cmp.Equal(config.RunCmd[0], []string{"sh", config.WriteFiles[0].Path}) {
+		t.Errorf("runcmd %v doesn't run %v", config.RunCmd[0], config.WriteFiles[0].Path)
+	}
+
+	// The script must survive the round trip and use build semantics.
+	want, err := Shell(context.Background(), grp, Options{Build: true})
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if config.WriteFiles[0].Content != want {
+		t.Errorf("script differs: %v", cmp.Diff(want, config.WriteFiles[0].Content))
+	}
+
+	files, err := runScript(t, config.WriteFiles[0].Content, "HAVE_B=1")
+	if err != nil {
+		t.Fatalf("script failed: %v", err)
+	}
+	wantFiles := map[string]string{
+		"build":      "",
+		"tool":       "b\n",
+		"log":        "it's b\n",
+		"needs-tool": "b\n",
+		"heredoc":    "done\n",
+	}
+	if !cmp.Equal(files, wantFiles) {
+		t.Errorf("unexpected files: %v", cmp.Diff(wantFiles, files))
+	}
+}
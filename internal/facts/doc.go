@@ -0,0 +1,3 @@
+// Package facts detects properties of the system being configured, such as its OS and distribution,
+// so that recipes can apply to some systems only.
+package facts
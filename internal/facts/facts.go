@@ -0,0 +1,200 @@
+package facts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+// Facts describe the system being configured.
+type Facts struct {
+	// OS is the kernel name in lower case, such as linux or darwin.
+	OS string
+	// Arch is the machine architecture in Go's terms, such as amd64 or arm64.
+	Arch   string
+	Kernel string
+	// Distro is the ID from /etc/os-release, or macos.
+	Distro        string
+	DistroVersion string
+	// DistroLike are the distributions this one is derived from, from ID_LIKE in /etc/os-release.
+	DistroLike []string
+	// Container is set inside a container.
+	Container bool
+	// Build is set while building an image.
+	Build bool
+}
+
+// Names are the names of the facts, as used by when conditions.
+var Names = []string{"os", "arch", "kernel", "distro", "distro_version", "distro_like", "container", "build"}
+
+// Values returns the values of each fact by name.
+func (f Facts) Values() map[string][]string {
+	return map[string][]string{
+		"os":             {f.OS},
+		"arch":           {f.Arch},
+		"kernel":         {f.Kernel},
+		"distro":         {f.Distro},
+		"distro_version": {f.DistroVersion},
+		"distro_like":    f.DistroLike,
+		"container":      {strconv.FormatBool(f.Container)},
+		"build":          {strconv.FormatBool(f.Build)},
+	}
+}
+
+// Match returns whether the system satisfies every fact of the condition.
+// A fact is satisfied if one of its values matches one of the condition's patterns, and none matches a negated one.
+func (f Facts) Match(when parse.When) (bool, error) {
+	values := f.Values()
+	for name, patterns := range when {
+		have, ok := values[name]
+		if !ok {
+			return false, fmt.Errorf("unknown fact %q", name)
+		}
+		var include, exclude []string
+		for _, pattern := range patterns {
+			if strings.HasPrefix(pattern, "!") {
+				exclude = append(exclude, pattern[1:])
+			} else {
+				include = append(include, pattern)
+			}
+		}
+		included, err := matchAny(include, have)
+		if err != nil {
+			return false, fmt.Errorf("fact %q: %w", name, err)
+		}
+		excluded, err := matchAny(exclude, have)
+		if err != nil {
+			return false, fmt.Errorf("fact %q: %w", name, err)
+		}
+		if (len(include) > 0 && !included) || excluded {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func matchAny(patterns, values []string) (bool, error) {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			ok, err := path.Match(pattern, value)
+			if err != nil {
+				return false, fmt.Errorf("bad pattern %q: %w", pattern, err)
+			}
+			if ok {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Script prints the facts it detects as name=value lines.
+// The build fact isn't detected, since a build can't be told apart from a container.
+const Script = `os=$(uname -s | tr '[:upper:]' '[:lower:]')
+echo "os=$os"
+case $(uname -m) in
+x86_64 | amd64) echo "arch=amd64" ;;
+aarch64 | arm64) echo "arch=arm64" ;;
+armv6* | armv7*) echo "arch=arm" ;;
+i?86) echo "arch=386" ;;
+*) echo "arch=$(uname -m)" ;;
+esac
+echo "kernel=$(uname -r)"
+if [ -r /etc/os-release ]; then
+	(
+		. /etc/os-release
+		echo "distro=$ID"
+		echo "distro_version=$VERSION_ID"
+		echo "distro_like=$ID_LIKE"
+	)
+elif [ "$os" = darwin ]; then
+	echo "distro=macos"
+	echo "distro_version=$(sw_vers -productVersion)"
+fi
+if [ -f /.dockerenv ] || [ -f /run/.containerenv ] || [ -n "${container:-}" ] ||
+	grep -qE 'docker|kubepods|containerd|lxc' /proc/1/cgroup 2>/dev/null; then
+	echo "container=true"
+else
+	echo "container=false"
+fi
+`
+
+// Gather detects the facts of the system e runs scripts on.
+func Gather(ctx context.Context, e runner.Executor) (Facts, error) {
+	var stdout, stderr bytes.Buffer
+	err := e.Run(ctx, Script, runner.Output{Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		return Facts{}, fmt.Errorf("gather facts of %s: %w: %s", e, err, strings.TrimSpace(stderr.String()))
+	}
+	return Parse(stdout.Bytes())
+}
+
+// Parse parses the output of Script.
+func Parse(b []byte) (Facts, error) {
+	var f Facts
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return Facts{}, fmt.Errorf("malformed fact %q", line)
+		}
+		name, value := line[:i], line[i+1:]
+		switch name {
+		case "os":
+			f.OS = value
+		case "arch":
+			f.Arch = value
+		case "kernel":
+			f.Kernel = value
+		case "distro":
+			f.Distro = value
+		case "distro_version":
+			f.DistroVersion = value
+		case "distro_like":
+			f.DistroLike = strings.Fields(value)
+		case "container":
+			f.Container = value == "true"
+		case "build":
+			f.Build = value == "true"
+		default:
+			return Facts{}, fmt.Errorf("unknown fact %q", name)
+		}
+	}
+	return f, s.Err()
+}
+
+// ForImage guesses the facts of an image build from its base image and platform, such as linux/arm64.
+// The distribution is taken from the base's repository name and its version from the tag,
+// so "ubuntu:22.04" has distro ubuntu and distro_version 22.04.
+func ForImage(base, platform string) Facts {
+	f := Facts{OS: "linux", Arch: runtime.GOARCH, Container: true, Build: true}
+	if parts := strings.Split(platform, "/"); len(parts) >= 2 {
+		f.OS, f.Arch = parts[0], parts[1]
+	}
+
+	repo := base
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo = repo[:i]
+	}
+	// A colon after the last slash separates the tag, a colon before it is a registry port.
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		if tag := repo[i+1:]; tag != "latest" {
+			f.DistroVersion = tag
+		}
+		repo = repo[:i]
+	}
+	f.Distro = repo[strings.LastIndex(repo, "/")+1:]
+	return f
+}
@@ -0,0 +1,112 @@
+package facts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+
+	f := Facts{
+		OS:            "linux",
+		Arch:          "amd64",
+		Distro:        "ubuntu",
+		DistroVersion: "22.04",
+		DistroLike:    []string{"debian"},
+	}
+	tcs := []struct {
+		name    string
+		when    parse.When
+		want    bool
+		wantErr bool
+	}{
+		{name: "Empty", want: true},
+		{name: "Equal", when: parse.When{"os": {"linux"}, "arch": {"amd64"}}, want: true},
+		{name: "AllFacts", when: parse.When{"os": {"linux"}, "arch": {"arm64"}}, want: false},
+		{name: "AnyValue", when: parse.When{"distro": {"fedora", "ubuntu"}}, want: true},
+		{name: "Glob", when: parse.When{"distro_version": {"22.*"}}, want: true},
+		{name: "List", when: parse.When{"distro_like": {"debian"}}, want: true},
+		{name: "Negated", when: parse.When{"distro": {"!ubuntu"}}, want: false},
+		{name: "NegatedOther", when: parse.When{"distro": {"!alpine"}}, want: true},
+		{name: "Bool", when: parse.When{"container": {"false"}}, want: true},
+		{name: "Unknown", when: parse.When{"color": {"blue"}}, wantErr: true},
+		{name: "BadPattern", when: parse.When{"os": {"["}}, wantErr: true},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := f.Match(tc.when)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGather(t *testing.T) {
+	t.Parallel()
+
+	f, err := Gather(context.Background(), runner.Local{})
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	if f.OS == "" || f.Arch == "" || f.Kernel == "" {
+		t.Errorf("missing facts: %+v", f)
+	}
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	got, err := Parse([]byte("os=linux\narch=arm64\ndistro=pop\ndistro_like=ubuntu debian\ncontainer=true\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := Facts{OS: "linux", Arch: "arm64", Distro: "pop", DistroLike: []string{"ubuntu", "debian"}, Container: true}
+	if !cmp.Equal(got, want) {
+		t.Errorf("unexpected facts: %v", cmp.Diff(want, got))
+	}
+
+	_, err = Parse([]byte("os linux\n"))
+	if err == nil {
+		t.Errorf("expected malformed line to be rejected")
+	}
+}
+
+func TestForImage(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		base     string
+		platform string
+		want     Facts
+	}{
+		{
+			base:     "ubuntu:22.04",
+			platform: "linux/arm64",
+			want:     Facts{OS: "linux", Arch: "arm64", Distro: "ubuntu", DistroVersion: "22.04", Container: true, Build: true},
+		},
+		{
+			base:     "registry.example.com:5000/library/alpine:latest",
+			platform: "linux/amd64",
+			want:     Facts{OS: "linux", Arch: "amd64", Distro: "alpine", Container: true, Build: true},
+		},
+	}
+	for _, tc := range tcs {
+		got := ForImage(tc.base, tc.platform)
+		if !cmp.Equal(got, tc.want) {
+			t.Errorf("%s: unexpected facts: %v", tc.base, cmp.Diff(tc.want, got))
+		}
+	}
+}
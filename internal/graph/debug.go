@@ -4,8 +4,8 @@ import "cdr.dev/nfy/internal/clog"
 
 func (ri RecipeIndex) Dump() {
 	clog.Debug("begin index dump")
-	for i, r := range ri {
-		clog.Debug("%v: %v", i, r)
+	for _, name := range ri.Names() {
+		clog.Debug("%v: %v", name, ri[name])
 	}
 	clog.Debug("end index dump")
 }
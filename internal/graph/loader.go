@@ -7,11 +7,13 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"cdr.dev/nfy/internal/clog"
 	"cdr.dev/nfy/internal/lockfile"
+	"cdr.dev/nfy/internal/packages"
 	"cdr.dev/nfy/internal/parse"
 	"cdr.dev/nfy/internal/runner"
 )
@@ -32,10 +34,15 @@ type Installer struct {
 // Recipe represents a loaded recipe.
 type Recipe struct {
 	Installers []Installer
+
+	// order is the position the recipe was declared at.
+	order int
 }
 
 type localLoader struct {
 	name string
+	// source is where the dependency is declared.
+	source parse.Pos
 	ind    RecipeIndex
 }
 
@@ -46,20 +53,53 @@ func (l *localLoader) Name() string {
 func (l *localLoader) Load(_ context.Context) (*Recipe, error) {
 	r, ok := l.ind[l.name]
 	if !ok {
-		return nil, fmt.Errorf("%s: recipe not found locally", l.name)
+		return nil, parse.Errorf(l.source, "%s: recipe not found locally", l.name)
 	}
 	return &r, nil
 }
 
+// managerRepo is the repo of the built-in recipes that check whether a package manager is available,
+// such as nfy:apt.
+const managerRepo = "nfy"
+
+// managerLoader loads the built-in recipe that checks whether a package manager is available.
+type managerLoader struct {
+	manager packages.Manager
+}
+
+func (l *managerLoader) Name() string {
+	return managerRepo + ":" + l.manager.Name
+}
+
+func (l *managerLoader) Load(context.Context) (*Recipe, error) {
+	return &Recipe{Installers: []Installer{{
+		Runner: runner.Installer{
+			Recipe: parse.Recipe{Name: l.manager.Name, Check: l.manager.Available},
+			Repo:   managerRepo,
+		},
+	}}}, nil
+}
+
 type remoteLoader struct {
 	raw string
 
 	target remoteTarget
 
-	// parent is provided for error reporting.
+	// parent and source are provided for error reporting.
 	parent string
+	source parse.Pos
 
 	config RemoteConfig
+
+	// result is shared by the loaders of the same dependency, and by every traversal of the graph.
+	result *remoteResult
+}
+
+// remoteResult is the outcome of loading a remote dependency, which is cloned once, on the first load.
+type remoteResult struct {
+	once   sync.Once
+	recipe *Recipe
+	err    error
 }
 
 func (l *remoteLoader) Name() string {
@@ -87,6 +127,18 @@ func (l *remoteLoader) lock() (func(), error) {
 }
 
 func (l *remoteLoader) Load(ctx context.Context) (*Recipe, error) {
+	l.result.once.Do(func() {
+		l.result.recipe, l.result.err = l.load(ctx)
+	})
+	if l.result.err != nil {
+		return nil, parse.Errorf(l.source, "%s: %w", l.raw, l.result.err)
+	}
+	// The installers are shared, so they mustn't be modified, but the recipe itself is the caller's.
+	r := *l.result.recipe
+	return &r, nil
+}
+
+func (l *remoteLoader) load(ctx context.Context) (*Recipe, error) {
 	unlock, err := l.lock()
 	if err != nil {
 		return nil, err
@@ -116,18 +168,40 @@ func (l *remoteLoader) Load(ctx context.Context) (*Recipe, error) {
 	}
 	clog.Success("cloned %v", l.raw)
 
-	var recipes []parse.Recipe
-	err = parse.Traverse(&recipes, filepath.Join(dir, "nfy.yml"))
+	cmd = exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	commit, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve commit: %w", err)
+	}
+	revision := l.target.Repo + "@" + strings.TrimSpace(string(commit))
+
+	var res parse.Result
+	err = parse.Traverse(&res, filepath.Join(dir, "nfy.yml"))
 	if err != nil {
 		return nil, err
 	}
 
-	grp, err := Generate(runner.FromParseRecipes(recipes, l.raw), l.config)
+	installers := runner.FromParseRecipes(res.Recipes, l.raw)
+	for i := range installers {
+		installers[i].Revision = revision
+	}
+	target := l.target.Target
+	var instances []string
+	if name, args, ok := parse.ParseInstance(target); ok {
+		target = parse.InstanceName(name, args)
+		instances = append(instances, target)
+	}
+	grp, err := generate(installers, l.config, instances)
+	if err != nil {
+		return nil, err
+	}
+	err = grp.Validate()
 	if err != nil {
 		return nil, err
 	}
 
-	targetGraph, ok := grp[l.target.Target]
+	targetGraph, ok := grp[target]
 	if !ok {
 		return nil, fmt.Errorf("repo does not have target %v", l.target.Target)
 	}
@@ -0,0 +1,151 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+
+	"cdr.dev/nfy/internal/runner"
+)
+
+// Step is an installer selected by traversal.
+type Step struct {
+	runner.Installer
+	// Deps are the full names of the installers the step's dependencies resolved to.
+	Deps []string
+}
+
+// Plan traverses the graph like Traverse and returns the presented installers in the order they were presented,
+// so each step comes after the steps it depends on.
+// fn is called once per target, as with TraverseOnce. If it returns an error, the installer isn't used.
+func (ri RecipeIndex) Plan(ctx context.Context, fn TraverseFn) ([]Step, error) {
+	var steps []Step
+	done := make(map[string]error)
+	visit := func(r runner.Installer, deps []string) error {
+		if err, ok := done[r.FullName()]; ok {
+			return err
+		}
+		err := fn(r)
+		done[r.FullName()] = err
+		if err == nil {
+			steps = append(steps, Step{Installer: r, Deps: deps})
+		}
+		return err
+	}
+
+	for _, name := range ri.Names() {
+		_, err := ri[name].walk(ctx, name, visit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return steps, nil
+}
+
+// Probes returns the full names of the recipes in ri that other recipes in ri depend on, and that only check for
+// or group requirements rather than installing anything.
+// They're requirements of the installers that depend on them rather than targets of their own,
+// so an overloaded recipe can probe for one without it being an error when it isn't met.
+func (ri RecipeIndex) Probes() map[string]bool {
+	probes := make(map[string]bool)
+	for _, r := range ri {
+		for _, ins := range r.Installers {
+			for _, dep := range ins.Dependencies {
+				d, ok := ri[dep.Name()]
+				if !ok || len(d.Installers) == 0 {
+					continue
+				}
+				requirement := true
+				for _, ins := range d.Installers {
+					groups := ins.Runner.Script == "" && ins.Runner.Recipe.Check == ""
+					requirement = requirement && (ins.Runner.CheckOnly() || groups)
+				}
+				if requirement {
+					probes[d.Installers[0].Runner.FullName()] = true
+				}
+			}
+		}
+	}
+	return probes
+}
+
+// Alternatives is a recipe along with every installer that could be used for it.
+type Alternatives struct {
+	// Name is the full name of the recipe.
+	Name string
+	// Steps has a step for each installer, in the order they would be tried.
+	Steps []Step
+	// Root is whether the recipe is in the index itself, rather than only being a dependency.
+	Root bool
+}
+
+// PlanAlternatives is like Plan, except that it doesn't select installers.
+// Instead, every installer of a recipe is planned along with its dependencies, so that the selection can be made
+// later, e.g when a generated script runs.
+// An installer is left out if its dependencies can't be loaded.
+func (ri RecipeIndex) PlanAlternatives(ctx context.Context) ([]Alternatives, error) {
+	p := &altPlanner{done: make(map[string]error)}
+	for _, name := range ri.Names() {
+		fullName, err := p.walk(ctx, name, ri[name])
+		if err != nil {
+			return nil, err
+		}
+		for i := range p.plan {
+			if p.plan[i].Name == fullName {
+				p.plan[i].Root = true
+			}
+		}
+	}
+	return p.plan, nil
+}
+
+type altPlanner struct {
+	plan []Alternatives
+	done map[string]error
+}
+
+// walk plans r and returns its full name.
+func (p *altPlanner) walk(ctx context.Context, parent string, r Recipe) (string, error) {
+	if len(r.Installers) == 0 {
+		return "", fmt.Errorf("%s: recipe has no installers", parent)
+	}
+	name := r.Installers[0].Runner.FullName()
+	if err, ok := p.done[name]; ok {
+		return name, err
+	}
+	// Guards against dependency cycles.
+	p.done[name] = fmt.Errorf("%s: dependency cycle", name)
+
+	var (
+		alts = Alternatives{Name: name}
+		errs depErrors
+	)
+	for _, ins := range r.Installers {
+		var deps []string
+		var depErr *depError
+		for _, dep := range ins.Dependencies {
+			r, err := dep.Load(ctx)
+			if err == nil {
+				var depName string
+				depName, err = p.walk(ctx, parent, *r)
+				deps = append(deps, depName)
+			}
+			if err != nil {
+				depErr = &depError{ins: ins, parent: parent, err: err}
+				break
+			}
+		}
+		if depErr != nil {
+			errs = append(errs, depErr)
+			continue
+		}
+		alts.Steps = append(alts.Steps, Step{Installer: ins.Runner, Deps: deps})
+	}
+	if len(alts.Steps) == 0 {
+		p.done[name] = errs
+		return name, errs
+	}
+
+	p.done[name] = nil
+	p.plan = append(p.plan, alts)
+	return name, nil
+}
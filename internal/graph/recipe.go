@@ -1,34 +1,57 @@
 package graph
 
 import (
-	"fmt"
 	"strings"
 
+	"cdr.dev/nfy/internal/packages"
+	"cdr.dev/nfy/internal/parse"
 	"cdr.dev/nfy/internal/runner"
 )
 
 type RecipeIndex map[string]Recipe
 
 // evalDepList evaluates a string dependency list and produces a set of virtual recipe loaders.
-func evalDepList(parent string, remoteConfig RemoteConfig, deps []string, ind RecipeIndex) ([]RecipeLoader, error) {
+// sources are the positions of the dependencies, for errors.
+// Remote dependencies with the same name share their entry in remotes, so each is only loaded once.
+func evalDepList(parent string, remoteConfig RemoteConfig, deps []string, sources []parse.Pos, ind RecipeIndex, remotes map[string]*remoteResult) ([]RecipeLoader, error) {
 	var ls []RecipeLoader
-	for _, dep := range deps {
-		if strings.Index(dep, ":") >= 0 {
+	for i, dep := range deps {
+		var source parse.Pos
+		if i < len(sources) {
+			source = sources[i]
+		}
+		// The args of an instance may contain colons too.
+		head := dep
+		if i := strings.Index(dep, "("); i >= 0 {
+			head = dep[:i]
+		}
+		if strings.Index(head, ":") >= 0 {
 			t, err := parseRemoteTarget(dep)
 			if err != nil {
-				return nil, fmt.Errorf("%q is misformatted: %w", dep, err)
+				return nil, parse.Errorf(source, "%q is misformatted: %w", dep, err)
+			}
+			result, ok := remotes[dep]
+			if !ok {
+				result = &remoteResult{}
+				remotes[dep] = result
 			}
 			ls = append(ls, &remoteLoader{
 				raw:    dep,
 				target: *t,
 				parent: parent,
+				source: source,
 				config: remoteConfig,
+				result: result,
 			})
 			continue
 		}
+		if name, args, ok := parse.ParseInstance(dep); ok {
+			dep = parse.InstanceName(name, args)
+		}
 		// TODO: support remote dependencies.
 		ls = append(ls, &localLoader{
 			name:   dep,
+			source: source,
 			ind:    ind,
 		})
 	}
@@ -41,24 +64,158 @@ type RemoteConfig struct {
 }
 
 // Generate produces a graph for each recipe.
+// Templates aren't recipes themselves. Their instances, listed by for_each or named by dependencies such as
+// apt-pkg(htop), are expanded into recipes instead, with the args as the values of the template's params.
 func Generate(installers []runner.Installer, rconfig RemoteConfig) (RecipeIndex, error) {
-	localIndex := make(RecipeIndex, len(installers))
+	return generate(installers, rconfig, nil)
+}
 
+// generate implements Generate, also expanding the given instances.
+func generate(installers []runner.Installer, rconfig RemoteConfig, instances []string) (RecipeIndex, error) {
+	g := &generator{
+		index:     make(RecipeIndex, len(installers)),
+		templates: make(map[string][]runner.Installer),
+		rconfig:   rconfig,
+		remotes:   make(map[string]*remoteResult),
+	}
 	for _, installer := range installers {
-		// We always append to the exist recipe's installers.
-		r, _ := localIndex[installer.Recipe.Name]
+		if installer.Recipe.Params != nil {
+			name := installer.Recipe.Name
+			g.templates[name] = append(g.templates[name], installer)
+		}
+	}
 
-		loaders, err := evalDepList(installer.FullName(), rconfig, installer.Dependencies, localIndex)
+	expanded := make(map[string]bool)
+	for _, installer := range installers {
+		if installer.Recipe.Params == nil {
+			err := g.add(installer)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Instances are declared where their template is.
+		name := installer.Recipe.Name
+		if expanded[name] {
+			continue
+		}
+		expanded[name] = true
+		for _, tmpl := range g.templates[name] {
+			for _, args := range tmpl.Recipe.ForEach {
+				err := g.instantiate(name, args)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for _, instance := range instances {
+		g.pending = append(g.pending, pendingInstance{name: instance})
+	}
+	// Instantiating a template may add dependencies on further instances.
+	for i := 0; i < len(g.pending); i++ {
+		p := g.pending[i]
+		name, args, _ := parse.ParseInstance(p.name)
+		tmpl, ok := g.templates[name]
+		if !ok {
+			// The dependency fails to load, like that on any missing recipe.
+			continue
+		}
+		instance := parse.InstanceName(name, args)
+		if params := tmpl[0].Recipe.Params; len(args) != len(params) {
+			if _, ok := g.index[instance]; !ok {
+				// Like a missing recipe, the instance only fails once it's traversed.
+				err := parse.Errorf(p.source, "%s takes %d args (%s), got %d", name, len(params), strings.Join(params, ", "), len(args))
+				g.index[instance] = Recipe{
+					Installers: []Installer{{
+						Runner:       runner.Installer{Recipe: parse.Recipe{Name: instance}},
+						Dependencies: []RecipeLoader{&errLoader{name: instance, err: err}},
+					}},
+					order: len(g.index),
+				}
+			}
+			continue
+		}
+		err := g.instantiate(name, args)
 		if err != nil {
 			return nil, err
 		}
-		r.Installers = append(r.Installers, Installer{
-			Runner:       installer,
-			Name:         installer.Name,
-			Dependencies: loaders,
-		})
-		localIndex[installer.Recipe.Name] = r
+	}
+	return g.index, nil
+}
+
+// generator accumulates the recipes of an index.
+type generator struct {
+	index RecipeIndex
+	// templates holds the installers of each template.
+	templates map[string][]runner.Installer
+	// pending are the instances that recipes depend on, which may not be expanded yet.
+	pending []pendingInstance
+	rconfig RemoteConfig
+	// remotes are the results of loading each remote dependency.
+	remotes map[string]*remoteResult
+}
+
+type pendingInstance struct {
+	name   string
+	source parse.Pos
+}
+
+func (g *generator) add(installer runner.Installer) error {
+	// We always append to the exist recipe's installers.
+	r, ok := g.index[installer.Recipe.Name]
+	if !ok {
+		r.order = len(g.index)
 	}
 
-	return localIndex, nil
+	loaders, err := evalDepList(installer.FullName(), g.rconfig, installer.Dependencies, installer.DependencySources, g.index, g.remotes)
+	if err != nil {
+		return err
+	}
+	if m, ok := packages.Lookup(installer.Manager); ok {
+		// The installer is only usable where its package manager is.
+		loaders = append([]RecipeLoader{&managerLoader{manager: m}}, loaders...)
+	}
+	for _, l := range loaders {
+		if l, ok := l.(*localLoader); ok {
+			if _, _, ok := parse.ParseInstance(l.name); ok {
+				g.pending = append(g.pending, pendingInstance{name: l.name, source: l.source})
+			}
+		}
+	}
+	r.Installers = append(r.Installers, Installer{
+		Runner:       installer,
+		Name:         installer.Name,
+		Dependencies: loaders,
+	})
+	g.index[installer.Recipe.Name] = r
+	return nil
+}
+
+// instantiate adds the instance of the template name with args, unless it's already added.
+// There must be an arg for each param.
+func (g *generator) instantiate(name string, args []string) error {
+	tmpl := g.templates[name]
+	params := tmpl[0].Recipe.Params
+	instance := parse.InstanceName(name, args)
+	if _, ok := g.index[instance]; ok {
+		return nil
+	}
+
+	values := make(map[string]string, len(params))
+	for i, param := range params {
+		values[param] = args[i]
+	}
+	for _, installer := range tmpl {
+		installer.Recipe.Name = instance
+		installer.Recipe.Params = nil
+		installer.Recipe.ForEach = nil
+		installer.Recipe.Args = values
+		err := g.add(installer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,218 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+func TestGenerateInstances(t *testing.T) {
+	t.Parallel()
+
+	res, err := parse.Parse(strings.NewReader(`apt-get:
+  check: "apt-get -h"
+apt-pkg:
+  params: [name]
+  for_each: [htop, wget]
+  check: "{{ .Params.name }} -h"
+  install: "apt-get install -y {{ .Params.name }}"
+  deps:
+    - apt-get
+apt-repo:
+  params: [repo]
+  install: "add-apt-repository -y {{ .Params.repo }}"
+python:
+  install: "apt-get install -y python3.12"
+  deps:
+    - apt-repo(ppa:deadsnakes/ppa)
+    - apt-pkg(software-properties-common)
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := Generate(runner.FromParseRecipes(res.Recipes, ""), RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	want := []string{
+		"apt-get",
+		"apt-pkg(htop)",
+		"apt-pkg(wget)",
+		"python",
+		"apt-repo(ppa:deadsnakes/ppa)",
+		"apt-pkg(software-properties-common)",
+	}
+	if !cmp.Equal(grp.Names(), want) {
+		t.Errorf("unexpected recipes: %v", cmp.Diff(want, grp.Names()))
+	}
+
+	var scripts []string
+	err = grp.Render(TemplateData{}).Traverse(context.Background(), TraverseOnce(func(r runner.Installer) error {
+		if r.Script != "" {
+			scripts = append(scripts, r.Script)
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("traverse: %v", err)
+	}
+	wantScripts := []string{
+		"apt-get install -y htop",
+		"apt-get install -y wget",
+		"add-apt-repository -y ppa:deadsnakes/ppa",
+		"apt-get install -y software-properties-common",
+		"apt-get install -y python3.12",
+	}
+	if !cmp.Equal(scripts, wantScripts) {
+		t.Errorf("unexpected scripts: %v", cmp.Diff(wantScripts, scripts))
+	}
+}
+
+func TestGenerateInstanceArity(t *testing.T) {
+	t.Parallel()
+
+	res, err := parse.Parse(strings.NewReader(`apt-pkg:
+  params: [name]
+  install: "apt-get install -y {{ .Params.name }}"
+tools:
+  deps:
+    - apt-pkg(htop, 3.2)
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := Generate(runner.FromParseRecipes(res.Recipes, ""), RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	err = grp.Traverse(context.Background(), func(runner.Installer) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "tools -> 6:7: apt-pkg takes 1 args (name), got 2") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestGeneratePackages(t *testing.T) {
+	t.Parallel()
+
+	res, err := parse.Parse(strings.NewReader(`tools:
+  packages:
+    apt: [htop, wget]
+    brew: [htop, wget]
+  deps:
+    - fonts
+fonts:
+  install: "echo fonts"
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := Generate(runner.FromParseRecipes(res.Recipes, ""), RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	// Each manager's installer depends on the manager being available, so a missing manager falls back to the next.
+	steps, err := grp.Plan(context.Background(), func(r runner.Installer) error {
+		if r.FullName() == "nfy:apt" {
+			return fmt.Errorf("apt isn't available")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	var got []string
+	for _, step := range steps {
+		got = append(got, fmt.Sprintf("%s %s %v", step.FullName(), step.Name, step.Deps))
+	}
+	want := []string{
+		"nfy:brew  []",
+		"fonts  []",
+		"tools brew [nfy:brew fonts]",
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("unexpected plan: %v", cmp.Diff(want, got))
+	}
+	if check := steps[2].Recipe.Check; check != "brew list --versions htop >/dev/null 2>&1 && brew list --versions wget >/dev/null 2>&1" {
+		t.Errorf("unexpected check %q", check)
+	}
+}
+
+func TestParseRemoteTarget(t *testing.T) {
+	t.Parallel()
+
+	for raw, want := range map[string]remoteTarget{
+		"github.com/user/repo:wget":                    {Repo: "github.com/user/repo", Target: "wget"},
+		"github.com/user/repo@v1.0.0:wget":             {Repo: "github.com/user/repo", Tag: "v1.0.0", Target: "wget"},
+		"github.com/user/repo@v1:apt-repo(ppa:x/y, 2)": {Repo: "github.com/user/repo", Tag: "v1", Target: "apt-repo(ppa:x/y, 2)"},
+	} {
+		got, err := parseRemoteTarget(raw)
+		if err != nil {
+			t.Errorf("%s: %v", raw, err)
+			continue
+		}
+		if !cmp.Equal(*got, want) {
+			t.Errorf("%s: %v", raw, cmp.Diff(want, *got))
+		}
+	}
+}
+
+// TestRemoteLoadedOnce checks that a remote dependency is loaded once for every recipe and traversal needing it.
+func TestRemoteLoadedOnce(t *testing.T) {
+	t.Parallel()
+
+	res, err := parse.Parse(strings.NewReader(`htop:
+  install: "htop-installer"
+  deps:
+    - example.com/tools:installer
+wget:
+  install: "wget-installer"
+  deps:
+    - example.com/tools:installer
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := Generate(runner.FromParseRecipes(res.Recipes, ""), RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	htop := grp["htop"].Installers[0].Dependencies[0].(*remoteLoader)
+	wget := grp["wget"].Installers[0].Dependencies[0].(*remoteLoader)
+	if htop.result != wget.result {
+		t.Fatal("the loaders of the same remote don't share their result")
+	}
+	// Loading it for real would clone the repo, which fails.
+	installer := runner.Installer{
+		Repo:      "example.com/tools:installer",
+		Recipe:    parse.Recipe{Name: "installer", Check: "installer -h"},
+		Installer: parse.Installer{Script: "install-installer"},
+	}
+	htop.result.once.Do(func() {
+		htop.result.recipe = &Recipe{Installers: []Installer{{Runner: installer}}}
+	})
+
+	// Each host of nfy apply traverses the graph with its own facts and vars.
+	for i := 0; i < 2; i++ {
+		steps, err := grp.Render(TemplateData{}).Plan(context.Background(), func(runner.Installer) error { return nil })
+		if err != nil {
+			t.Fatalf("plan: %v", err)
+		}
+		var names []string
+		for _, step := range steps {
+			names = append(names, step.FullName())
+		}
+		want := []string{"example.com/tools:installer:installer", "htop", "wget"}
+		if !cmp.Equal(names, want) {
+			t.Errorf("unexpected steps: %v", cmp.Diff(want, names))
+		}
+	}
+}
@@ -15,7 +15,8 @@ type remoteTarget struct {
 	Tag string
 }
 
-var remoteTargetRegex = regexp.MustCompile(`^(?P<repo>[\w-/.]+)(?P<tag>@\S+)?:(?P<target>\S+)$`)
+// The target may be a template's instance, whose args may contain anything.
+var remoteTargetRegex = regexp.MustCompile(`^(?P<repo>[\w-/.]+)(?P<tag>@[^\s:]+)?:(?P<target>[^\s():]+(?:\(.*\))?)$`)
 
 // parseRemoteTarget parses a target like github.com/ammario/dotfiles@master:wget.
 func parseRemoteTarget(t string) (*remoteTarget, error) {
@@ -0,0 +1,79 @@
+package graph
+
+import (
+	"strings"
+	"text/template"
+
+	"cdr.dev/nfy/internal/facts"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+// TemplateData is what scripts are rendered with.
+type TemplateData struct {
+	// Facts are those of the system being configured. They're nil if it isn't known,
+	// so that templates referring to them fail instead of rendering empty values.
+	Facts *facts.Facts
+	Vars  map[string]string
+	// Name is the name of the recipe the script belongs to.
+	Name string
+	// Params are the values of the params of a template's instance, by param.
+	Params map[string]string
+}
+
+// Render returns a copy of the index in which checks and install scripts are rendered as templates with data,
+// including those of the recipes that are later loaded as dependencies.
+// Recipes whose templates fail to render fail to traverse.
+func (ri RecipeIndex) Render(data TemplateData) RecipeIndex {
+	return ri.mapRecipes(func(r Recipe) Recipe {
+		installers := make([]Installer, len(r.Installers))
+		for i, ins := range r.Installers {
+			rendered, err := renderInstaller(ins.Runner, data)
+			if err != nil {
+				return failedRecipe(r, err)
+			}
+			ins.Runner = rendered
+			installers[i] = ins
+		}
+		r.Installers = installers
+		return r
+	})
+}
+
+func renderInstaller(r runner.Installer, data TemplateData) (runner.Installer, error) {
+	data.Name = r.Recipe.Name
+	data.Params = r.Recipe.Args
+	var err error
+	r.Recipe.Check, err = renderScript("check", r.Recipe.Check, data)
+	if err != nil {
+		return r, parse.Errorf(r.Recipe.Source, "%s: %w", r.FullName(), err)
+	}
+	r.Script, err = renderScript("install", r.Script, data)
+	if err != nil {
+		pos := r.Source
+		if !pos.IsValid() {
+			pos = r.Recipe.Source
+		}
+		return r, parse.Errorf(pos, "%s: %w", r.FQDN(r.Recipe), err)
+	}
+	return r, nil
+}
+
+// renderScript renders script as a template with data. Scripts without actions are returned as is.
+// name identifies the script in errors.
+func renderScript(name, script string, data TemplateData) (string, error) {
+	if !strings.Contains(script, "{{") {
+		return script, nil
+	}
+	// Misspelled vars fail rather than render as "<no value>".
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(script)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = tmpl.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,76 @@
+package graph
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/facts"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+
+	res, err := parse.Parse(strings.NewReader(`kubectl:
+  check: "{{ .Name }} version --client"
+  install: "curl -sSfL -o /usr/local/bin/kubectl https://dl.k8s.io/{{ .Vars.VERSION }}/bin/linux/{{ .Facts.Arch }}/kubectl"
+jq:
+  check: "jq --version"
+  install: "apt-get install -y jq"
+typo:
+  install: "echo {{ .Vars.VERSOIN }}"
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := Generate(runner.FromParseRecipes(res.Recipes, ""), RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	scripts := func(grp RecipeIndex, name string) ([]string, error) {
+		var got []string
+		err := grp[name].Traverse(context.Background(), name, func(r runner.Installer) error {
+			got = append(got, r.Recipe.Check, r.Script)
+			return nil
+		})
+		return got, err
+	}
+
+	f := facts.Facts{Arch: "arm64"}
+	rendered := grp.Render(TemplateData{Facts: &f, Vars: map[string]string{"VERSION": "v1.30.0"}})
+	got, err := scripts(rendered, "kubectl")
+	if err != nil {
+		t.Fatalf("traverse: %v", err)
+	}
+	want := []string{
+		"kubectl version --client",
+		"curl -sSfL -o /usr/local/bin/kubectl https://dl.k8s.io/v1.30.0/bin/linux/arm64/kubectl",
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("unexpected scripts: %v", cmp.Diff(want, got))
+	}
+
+	got, err = scripts(rendered, "jq")
+	if err != nil {
+		t.Fatalf("traverse: %v", err)
+	}
+	if !cmp.Equal(got, []string{"jq --version", "apt-get install -y jq"}) {
+		t.Errorf("scripts without templates changed: %v", got)
+	}
+
+	_, err = scripts(rendered, "typo")
+	if err == nil || !strings.Contains(err.Error(), `8:3: typo: template: install:1:13: executing "install" at <.Vars.VERSOIN>`) {
+		t.Errorf("expected missing var to fail, got %v", err)
+	}
+
+	// Without facts, scripts referring to them fail.
+	_, err = scripts(grp.Render(TemplateData{Vars: map[string]string{"VERSION": "v1.30.0"}}), "kubectl")
+	if err == nil {
+		t.Errorf("expected unknown facts to fail")
+	}
+}
@@ -0,0 +1,153 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cdr.dev/nfy/internal/parse"
+)
+
+// mapRecipes returns a copy of the index with fn applied to every recipe,
+// including the recipes that are later loaded as dependencies.
+// fn must not modify the slices of the recipe it's given.
+func (ri RecipeIndex) mapRecipes(fn func(Recipe) Recipe) RecipeIndex {
+	mapped := make(RecipeIndex, len(ri))
+	for name, r := range ri {
+		mapped[name] = mapRecipe(r, fn)
+	}
+	return mapped
+}
+
+func mapRecipe(r Recipe, fn func(Recipe) Recipe) Recipe {
+	r = fn(r)
+	installers := make([]Installer, len(r.Installers))
+	for i, ins := range r.Installers {
+		deps := make([]RecipeLoader, len(ins.Dependencies))
+		for j, dep := range ins.Dependencies {
+			deps[j] = &mappedLoader{RecipeLoader: dep, fn: fn}
+		}
+		ins.Dependencies = deps
+		installers[i] = ins
+	}
+	r.Installers = installers
+	return r
+}
+
+// mappedLoader applies fn to the recipe it loads.
+type mappedLoader struct {
+	RecipeLoader
+	fn func(Recipe) Recipe
+}
+
+func (l *mappedLoader) Load(ctx context.Context) (*Recipe, error) {
+	r, err := l.RecipeLoader.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mapped := mapRecipe(*r, l.fn)
+	return &mapped, nil
+}
+
+// Prefer returns a copy of the index in which installers named in names are tried before the others,
+// in the order of names. Installers that aren't named keep their declared order.
+func (ri RecipeIndex) Prefer(names []string) RecipeIndex {
+	if len(names) == 0 {
+		return ri
+	}
+	rank := func(name string) int {
+		for i, n := range names {
+			if n == name {
+				return i
+			}
+		}
+		return len(names)
+	}
+	return ri.mapRecipes(func(r Recipe) Recipe {
+		installers := append([]Installer(nil), r.Installers...)
+		sort.SliceStable(installers, func(i, j int) bool {
+			return rank(installers[i].Name) < rank(installers[j].Name)
+		})
+		r.Installers = installers
+		return r
+	})
+}
+
+// When returns a copy of the index in which the when conditions of recipes and installers are evaluated by match.
+// A recipe whose condition doesn't match is skipped: it does nothing, and its dependents don't need it.
+// Installers whose conditions don't match are left out, and a recipe with none left fails to traverse.
+func (ri RecipeIndex) When(match func(parse.When) (bool, error)) RecipeIndex {
+	return ri.mapRecipes(func(r Recipe) Recipe {
+		if len(r.Installers) == 0 {
+			return r
+		}
+		first := r.Installers[0].Runner
+		ok, err := match(first.Recipe.When)
+		if err != nil {
+			return failedRecipe(r, parse.Errorf(first.Recipe.Source, "%s: %w", first.FullName(), err))
+		}
+		if !ok {
+			first.Skip = "when " + describeWhen(first.Recipe.When)
+			first.Installer = parse.Installer{}
+			return Recipe{Installers: []Installer{{Runner: first}}, order: r.order}
+		}
+
+		var kept []Installer
+		for _, ins := range r.Installers {
+			ok, err := match(ins.Runner.When)
+			if err != nil {
+				return failedRecipe(r, parse.Errorf(ins.Runner.Source, "%s: %w", ins.Runner.FullName(), err))
+			}
+			if ok {
+				kept = append(kept, ins)
+			}
+		}
+		if len(kept) == 0 {
+			return failedRecipe(r, parse.Errorf(first.Recipe.Source, "%s: no installer applies to this system", first.FullName()))
+		}
+		r.Installers = kept
+		return r
+	})
+}
+
+// failedRecipe returns a recipe in place of r that fails to traverse with err.
+func failedRecipe(r Recipe, err error) Recipe {
+	first := r.Installers[0].Runner
+	first.Installer = parse.Installer{}
+	return Recipe{
+		Installers: []Installer{{
+			Runner:       first,
+			Dependencies: []RecipeLoader{&errLoader{name: first.FullName(), err: err}},
+		}},
+		order: r.order,
+	}
+}
+
+// errLoader fails to load.
+type errLoader struct {
+	name string
+	err  error
+}
+
+func (l *errLoader) Name() string {
+	return l.name
+}
+
+func (l *errLoader) Load(context.Context) (*Recipe, error) {
+	return nil, l.err
+}
+
+// describeWhen formats a condition for logs, such as "distro=ubuntu,debian os=linux".
+func describeWhen(when parse.When) string {
+	names := make([]string, 0, len(when))
+	for name := range when {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	conds := make([]string, len(names))
+	for i, name := range names {
+		conds[i] = fmt.Sprintf("%s=%s", name, strings.Join(when[name], ","))
+	}
+	return strings.Join(conds, " ")
+}
@@ -0,0 +1,99 @@
+package graph
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/facts"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+func TestWhen(t *testing.T) {
+	t.Parallel()
+
+	res, err := parse.Parse(strings.NewReader(`brew:
+  check: "brew --version"
+  when:
+    os: darwin
+htop:
+  install_apt:
+    script: "apt-get install -y htop"
+    when:
+      distro_like: debian
+  install_brew:
+    script: "brew install htop"
+    deps:
+      - brew
+    when:
+      os: darwin
+tool:
+  install: "make install"
+  deps:
+    - brew
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := Generate(runner.FromParseRecipes(res.Recipes, ""), RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	tcs := []struct {
+		name    string
+		facts   facts.Facts
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "Debian",
+			facts: facts.Facts{OS: "linux", Distro: "ubuntu", DistroLike: []string{"debian"}},
+			want:  []string{"brew: when os=darwin", "htop[apt]", "tool"},
+		},
+		{
+			name:  "Darwin",
+			facts: facts.Facts{OS: "darwin", Distro: "macos"},
+			want:  []string{"brew", "htop[brew]", "tool"},
+		},
+		{
+			name:    "NoInstaller",
+			facts:   facts.Facts{OS: "linux", Distro: "alpine"},
+			wantErr: "htop -> 5:1: htop: no installer applies to this system",
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got []string
+			err := grp.When(tc.facts.Match).Traverse(context.Background(), TraverseOnce(func(r runner.Installer) error {
+				switch {
+				case r.Skip != "":
+					got = append(got, r.FullName()+": "+r.Skip)
+				case r.Name != "":
+					got = append(got, r.FullName()+"["+r.Name+"]")
+				default:
+					got = append(got, r.FullName())
+				}
+				return nil
+			}))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("traverse: %v", err)
+			}
+			if !cmp.Equal(got, tc.want) {
+				t.Errorf("unexpected installers: %v", cmp.Diff(tc.want, got))
+			}
+		})
+	}
+}
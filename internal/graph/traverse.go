@@ -12,35 +12,41 @@ import (
 type TraverseFn func(r runner.Installer) error
 
 // TraverseOnce returns a TraverseFn that only calls fn on each target once.
+// Later calls for the same target return the result of the first.
 func TraverseOnce(fn TraverseFn) TraverseFn {
-	skip := make(map[string]bool)
+	done := make(map[string]error)
 	return func(r runner.Installer) error {
-		if skip[r.FullName()] {
-			return nil
+		if err, ok := done[r.FullName()]; ok {
+			return err
 		}
 
 		err := fn(r)
-		skip[r.FullName()] = true
+		done[r.FullName()] = err
 		return err
 	}
 }
 
-// sortedSlice returns the map as a slice of keys in a deterministic order.
-func (ri RecipeIndex) sortedSlice() []Recipe {
-	var rs []Recipe
-	for _, v := range ri {
-		rs = append(rs, v)
+// Names returns the recipe names in declaration order.
+func (ri RecipeIndex) Names() []string {
+	names := make([]string, 0, len(ri))
+	for name := range ri {
+		names = append(names, name)
 	}
-	sort.Slice(rs, func(i, j int) bool {
-		return len(rs[i].Installers) < len(rs[j].Installers)
+	sort.Slice(names, func(i, j int) bool {
+		a, b := ri[names[i]], ri[names[j]]
+		if a.order != b.order {
+			return a.order < b.order
+		}
+		return names[i] < names[j]
 	})
-	return rs
+	return names
 }
 
 // Traverse traverses all recipes in the graph. It will only present recipes that it has presented all dependencies for.
+// Recipes are visited in declaration order, so the order of presentation is stable.
 func (ri RecipeIndex) Traverse(ctx context.Context, fn TraverseFn) error {
-	for name, r := range ri {
-		err := r.Traverse(ctx, name, fn)
+	for _, name := range ri.Names() {
+		err := ri[name].Traverse(ctx, name, fn)
 		if err != nil {
 			return err
 		}
@@ -58,26 +64,31 @@ func (l *depError) Error() string {
 	return l.err.Error()
 }
 
-func (r Recipe) tryInstaller(ctx context.Context, parent string, ins Installer, fn TraverseFn) *depError {
+// stepFn is called with an installer and the full names of the installers its dependencies resolved to.
+type stepFn func(r runner.Installer, deps []string) error
+
+func (r Recipe) tryInstaller(ctx context.Context, parent string, ins Installer, fn stepFn) ([]string, *depError) {
+	var deps []string
 	for _, dep := range ins.Dependencies {
 		r, err := dep.Load(ctx)
 		if err != nil {
-			return &depError{
+			return nil, &depError{
 				ins:    ins,
 				parent: parent,
 				err:    err,
 			}
 		}
-		err = r.Traverse(ctx, parent, fn)
+		name, err := r.walk(ctx, parent, fn)
 		if err != nil {
-			return &depError{
+			return nil, &depError{
 				ins:    ins,
 				parent: parent,
 				err:    err,
 			}
 		}
+		deps = append(deps, name)
 	}
-	return nil
+	return deps, nil
 }
 
 type depErrors []*depError
@@ -99,15 +110,25 @@ func (d depErrors) Error() string {
 // Traverse is depth-first.
 // It is eventually called against the Recipe itself.
 func (r Recipe) Traverse(ctx context.Context, parent string, fn TraverseFn) error {
+	_, err := r.walk(ctx, parent, func(r runner.Installer, _ []string) error {
+		return fn(r)
+	})
+	return err
+}
+
+// walk implements Traverse. It returns the full name of the installer that was presented for the recipe.
+func (r Recipe) walk(ctx context.Context, parent string, fn stepFn) (string, error) {
 	var (
 		installer Installer
+		deps      []string
 		errs      depErrors
 		lastErr   *depError
 	)
 
 	// Try each installer and use the one that works.
 	for _, installer = range r.Installers {
-		err := r.tryInstaller(ctx, parent, installer, fn)
+		var err *depError
+		deps, err = r.tryInstaller(ctx, parent, installer, fn)
 		lastErr = err
 		errs = append(errs, err)
 		if err == nil {
@@ -116,8 +137,8 @@ func (r Recipe) Traverse(ctx context.Context, parent string, fn TraverseFn) erro
 	}
 
 	if lastErr != nil {
-		return errs
+		return "", errs
 	}
 
-	return fn(installer.Runner)
+	return installer.Runner.FullName(), fn(installer.Runner, deps)
 }
@@ -0,0 +1,150 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+// TestTraverseExecutor checks that installers are selected by the checks that fail on the target.
+func TestTraverseExecutor(t *testing.T) {
+	t.Parallel()
+
+	res, err := parse.Parse(strings.NewReader(`
+apt-get:
+  check: "apt-get -h"
+brew:
+  check: "brew --version"
+wget:
+  check: "wget -h"
+  install_apt:
+    script: "apt-get install -y wget"
+    deps:
+      - apt-get
+  install_brew:
+    script: "brew install wget"
+    deps:
+      - brew
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := Generate(runner.FromParseRecipes(res.Recipes, ""), RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	ex := &runner.Fake{Fail: map[string]bool{"apt-get -h": true, "wget -h": true}}
+	var installed []string
+	err = grp["wget"].Traverse(context.Background(), "wget", TraverseOnce(func(r runner.Installer) error {
+		var out bytes.Buffer
+		output := runner.Output{Stdout: &out, Stderr: &out}
+		err := r.Check(context.Background(), ex, output)
+		if err == nil || r.CheckOnly() {
+			return err
+		}
+		installed = append(installed, r.FullName()+"["+r.Name+"]")
+		return r.Install(context.Background(), ex, output)
+	}))
+	if err != nil {
+		t.Fatalf("traverse: %v", err)
+	}
+
+	want := []string{"apt-get -h", "brew --version", "wget -h", "brew install wget"}
+	if !cmp.Equal(ex.Ran(), want) {
+		t.Errorf("unexpected scripts: %v", cmp.Diff(want, ex.Ran()))
+	}
+	if !cmp.Equal(installed, []string{"wget[brew]"}) {
+		t.Errorf("got installed %v, want wget[brew]", installed)
+	}
+}
+
+func TestTraverseMissingDependency(t *testing.T) {
+	t.Parallel()
+
+	res, err := parse.Parse(strings.NewReader(`htop:
+  install: "apt-get install -y htop"
+  deps:
+    - apt-get
+    - aptt
+apt-get:
+  check: "apt-get -h"
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := Generate(runner.FromParseRecipes(res.Recipes, ""), RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	err = grp.Traverse(context.Background(), func(runner.Installer) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "htop -> 5:7: aptt: recipe not found locally") {
+		t.Errorf("expected the missing dependency's position, got %v", err)
+	}
+}
+
+// TestTraverseOnceFailed checks that a requirement that failed isn't treated as met when it's revisited.
+func TestTraverseOnceFailed(t *testing.T) {
+	t.Parallel()
+
+	res, err := parse.Parse(strings.NewReader(`
+apt-get:
+  check: "apt-get -h"
+brew:
+  check: "brew --version"
+curl:
+  install_apt:
+    script: "apt-get install -y curl"
+    deps:
+      - apt-get
+  install_brew:
+    script: "brew install curl"
+    deps:
+      - brew
+jq:
+  install_apt:
+    script: "apt-get install -y jq"
+    deps:
+      - apt-get
+  install_brew:
+    script: "brew install jq"
+    deps:
+      - brew
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := Generate(runner.FromParseRecipes(res.Recipes, ""), RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	var installed []string
+	fn := TraverseOnce(func(r runner.Installer) error {
+		if r.FullName() == "apt-get" {
+			return errors.New("apt-get: not found")
+		}
+		if !r.CheckOnly() {
+			installed = append(installed, r.FullName()+"["+r.Name+"]")
+		}
+		return nil
+	})
+	// Both recipes fall back to brew, rather than jq taking apt-get for installed once curl gave up on it.
+	for _, name := range []string{"curl", "jq"} {
+		err = grp[name].Traverse(context.Background(), name, fn)
+		if err != nil {
+			t.Fatalf("traverse %v: %v", name, err)
+		}
+	}
+	want := []string{"curl[brew]", "jq[brew]"}
+	if !cmp.Equal(installed, want) {
+		t.Errorf("unexpected installs: %v", cmp.Diff(want, installed))
+	}
+}
@@ -0,0 +1,80 @@
+package graph
+
+import (
+	"fmt"
+	"strings"
+
+	"cdr.dev/nfy/internal/parse"
+)
+
+// ValidationErrors lists every problem found by Validate.
+type ValidationErrors []error
+
+func (v ValidationErrors) Error() string {
+	var s strings.Builder
+	for _, err := range v {
+		fmt.Fprintf(&s, "\n\t%v", err)
+	}
+	return "invalid config:" + s.String()
+}
+
+// localDeps returns the locally resolvable recipes the installer depends on.
+// Remote dependencies are not followed since that requires fetching them.
+func (ri RecipeIndex) localDeps(ins Installer) []string {
+	var names []string
+	for _, dep := range ins.Dependencies {
+		l, ok := dep.(*localLoader)
+		if !ok {
+			continue
+		}
+		if _, ok := ri[l.name]; ok {
+			names = append(names, l.name)
+		}
+	}
+	return names
+}
+
+// localOnlyDep returns the first local_only recipe reachable from name, if any.
+func (ri RecipeIndex) localOnlyDep(name string, seen map[string]bool) (string, bool) {
+	if seen[name] {
+		return "", false
+	}
+	seen[name] = true
+	for _, ins := range ri[name].Installers {
+		if ins.Runner.Recipe.LocalOnly {
+			return name, true
+		}
+		for _, dep := range ri.localDeps(ins) {
+			if found, ok := ri.localOnlyDep(dep, seen); ok {
+				return found, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Validate checks the local recipes for contradictions, such as a build_only recipe that depends on a local_only
+// one and could therefore never be built.
+func (ri RecipeIndex) Validate() error {
+	var errs ValidationErrors
+	for _, name := range ri.Names() {
+		for _, ins := range ri[name].Installers {
+			if !ins.Runner.Recipe.BuildOnly {
+				continue
+			}
+			seen := map[string]bool{name: true}
+			for _, dep := range ri.localDeps(ins) {
+				if found, ok := ri.localOnlyDep(dep, seen); ok {
+					errs = append(errs, parse.Errorf(ins.Runner.Recipe.Source,
+						"%s is build_only but depends on local_only %s", ins.Runner.FQDN(ins.Runner.Recipe), found,
+					))
+					break
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
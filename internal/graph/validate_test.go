@@ -0,0 +1,73 @@
+package graph
+
+import (
+	"strings"
+	"testing"
+
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{
+			name: "Valid",
+			body: `
+ssh-keys:
+  install: "ssh-keygen"
+  local_only: true
+apt-update:
+  install: "apt-get update"
+  build_only: true
+`,
+		},
+		{
+			name: "BuildOnlyDependsOnLocalOnly",
+			body: `
+ssh-keys:
+  install: "ssh-keygen"
+  local_only: true
+clone:
+  install: "git clone git@github.com:coder/nfy"
+  deps:
+    - ssh-keys
+apt-update:
+  install: "apt-get update"
+  build_only: true
+  deps:
+    - clone
+`,
+			wantErr: "apt-update is build_only but depends on local_only ssh-keys",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			res, err := parse.Parse(strings.NewReader(strings.TrimSpace(tc.body)))
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			grp, err := Generate(runner.FromParseRecipes(res.Recipes, ""), RemoteConfig{})
+			if err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+			err = grp.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
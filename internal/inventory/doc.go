@@ -0,0 +1,2 @@
+// Package inventory describes the fleet of hosts that nfy applies a configuration to.
+package inventory
@@ -0,0 +1,125 @@
+package inventory
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Host is a machine reached over ssh.
+type Host struct {
+	// Name identifies the host in output.
+	Name string `yaml:"name"`
+	// Address is the ssh destination, such as user@box. It defaults to the name.
+	Address string `yaml:"address"`
+	// SSHArgs are passed to the ssh client, to select a port or an identity for example.
+	SSHArgs []string `yaml:"ssh_args"`
+	// Targets are the targets to install on the host. Every target is installed if there are none.
+	Targets []string `yaml:"targets"`
+	// Vars are exported to scripts as environment variables.
+	Vars map[string]string `yaml:"vars"`
+}
+
+// Inventory is the contents of an inventory.yml.
+type Inventory struct {
+	// Vars are given to every host, unless the host sets them itself.
+	Vars  map[string]string `yaml:"vars"`
+	Hosts []Host            `yaml:"hosts"`
+}
+
+var varName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func checkVars(vars map[string]string) error {
+	for name := range vars {
+		if !varName.MatchString(name) {
+			return fmt.Errorf("%q isn't a valid environment variable name", name)
+		}
+	}
+	return nil
+}
+
+// Parse parses an inventory. Hosts get the defaults of the inventory, so they can be used as is.
+func Parse(r io.Reader) (*Inventory, error) {
+	var inv Inventory
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	err := dec.Decode(&inv)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	err = checkVars(inv.Vars)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i := range inv.Hosts {
+		h := &inv.Hosts[i]
+		if h.Name == "" {
+			return nil, fmt.Errorf("host %v has no name", i+1)
+		}
+		if seen[h.Name] {
+			return nil, fmt.Errorf("host %q is listed more than once", h.Name)
+		}
+		seen[h.Name] = true
+		err = checkVars(h.Vars)
+		if err != nil {
+			return nil, fmt.Errorf("host %q: %w", h.Name, err)
+		}
+
+		if h.Address == "" {
+			h.Address = h.Name
+		}
+		vars := make(map[string]string, len(inv.Vars)+len(h.Vars))
+		for k, v := range inv.Vars {
+			vars[k] = v
+		}
+		for k, v := range h.Vars {
+			vars[k] = v
+		}
+		h.Vars = vars
+	}
+	return &inv, nil
+}
+
+// Load parses the inventory at path.
+func Load(path string) (*Inventory, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	inv, err := Parse(fi)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return inv, nil
+}
+
+// Select returns the hosts with the given names, in inventory order. Every host is returned if names is empty.
+func (inv *Inventory) Select(names []string) ([]Host, error) {
+	if len(names) == 0 {
+		return inv.Hosts, nil
+	}
+	want := make(map[string]bool)
+	for _, name := range names {
+		want[name] = true
+	}
+	var hosts []Host
+	for _, h := range inv.Hosts {
+		if want[h.Name] {
+			hosts = append(hosts, h)
+			delete(want, h.Name)
+		}
+	}
+	for _, name := range names {
+		if want[name] {
+			return nil, fmt.Errorf("no host %q in the inventory", name)
+		}
+	}
+	return hosts, nil
+}
@@ -0,0 +1,74 @@
+package inventory
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	inv, err := Parse(strings.NewReader(`
+vars:
+  REGION: eu
+  TIER: 1
+hosts:
+  - name: web1
+    address: deploy@web1.example.com
+    ssh_args: ["-p", "2222"]
+    targets: [htop, wget]
+    vars:
+      TIER: 2
+  - name: db1
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := []Host{
+		{
+			Name:    "web1",
+			Address: "deploy@web1.example.com",
+			SSHArgs: []string{"-p", "2222"},
+			Targets: []string{"htop", "wget"},
+			Vars:    map[string]string{"REGION": "eu", "TIER": "2"},
+		},
+		{
+			Name:    "db1",
+			Address: "db1",
+			Vars:    map[string]string{"REGION": "eu", "TIER": "1"},
+		},
+	}
+	if !cmp.Equal(inv.Hosts, want) {
+		t.Errorf("unexpected hosts: %v", cmp.Diff(want, inv.Hosts))
+	}
+
+	hosts, err := inv.Select([]string{"db1"})
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if len(hosts) != 1 || hosts[0].Name != "db1" {
+		t.Errorf("got hosts %+v, want db1", hosts)
+	}
+	_, err = inv.Select([]string{"web2"})
+	if err == nil {
+		t.Errorf("expected unknown host to be rejected")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	t.Parallel()
+
+	for name, body := range map[string]string{
+		"NoName":       "hosts:\n  - address: box\n",
+		"Duplicate":    "hosts:\n  - name: box\n  - name: box\n",
+		"UnknownField": "hosts:\n  - name: box\n    user: root\n",
+		"BadVar":       "vars:\n  NOT-A-VAR: x\nhosts:\n  - name: box\n",
+	} {
+		_, err := Parse(strings.NewReader(body))
+		if err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+}
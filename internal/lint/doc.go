@@ -0,0 +1,2 @@
+// Package lint finds mistakes in a nfy config without installing anything.
+package lint
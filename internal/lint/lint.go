@@ -0,0 +1,324 @@
+package lint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"cdr.dev/nfy/internal/facts"
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/parse"
+)
+
+// Severity tells apart problems that break the config from questionable choices.
+type Severity int
+
+const (
+	Warning Severity = iota
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// Problem is a finding of a check.
+type Problem struct {
+	Pos      parse.Pos
+	Severity Severity
+	// Check names the check that found the problem.
+	Check   string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%v: %v: %v (%v)", p.Pos, p.Severity, p.Message, p.Check)
+}
+
+// Options configures Lint.
+type Options struct {
+	// Targets are the recipes that are meant to be installed. If set, recipes they don't reach are reported.
+	Targets []string
+	// Shell checks the syntax of scripts, "sh" if empty.
+	Shell string
+}
+
+// Lint checks the recipes of a config, and the graph generated from them, for mistakes.
+// Remote dependencies aren't fetched, so only local recipes are checked.
+func Lint(ctx context.Context, config *parse.Result, grp graph.RecipeIndex, opts Options) []Problem {
+	l := &linter{
+		config:  config,
+		recipes: make(map[string][]parse.Recipe),
+	}
+	for _, r := range config.Recipes {
+		l.recipes[r.Name] = append(l.recipes[r.Name], r)
+	}
+
+	l.duplicates()
+	l.missingDeps()
+	l.shadowedInstallers()
+	l.missingChecks()
+	l.conditions()
+	l.unreachable(opts.Targets)
+	l.validate(grp)
+	shell := opts.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+	l.syntax(ctx, shell)
+
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		a, b := l.problems[i].Pos, l.problems[j].Pos
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	// A file imported twice declares the same recipes twice, which isn't worth reporting twice.
+	var problems []Problem
+	seen := make(map[Problem]bool)
+	for _, p := range l.problems {
+		if !seen[p] {
+			seen[p] = true
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+type linter struct {
+	config *parse.Result
+	// recipes holds every declaration of each recipe name.
+	recipes  map[string][]parse.Recipe
+	problems []Problem
+}
+
+func (l *linter) report(pos parse.Pos, sev Severity, check, format string, args ...interface{}) {
+	l.problems = append(l.problems, Problem{
+		Pos:      pos,
+		Severity: sev,
+		Check:    check,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// duplicates reports recipes declared in more than one place. They're merged as if they were overloads,
+// which is rarely what was meant.
+func (l *linter) duplicates() {
+	for _, r := range l.config.Recipes {
+		first := l.recipes[r.Name][0]
+		if r.Source.File != first.Source.File {
+			l.report(r.Source, Error, "duplicate", "%v is already declared at %v", r.Name, first.Source)
+		}
+	}
+}
+
+// declaredName returns the name of the recipe that a dependency refers to, which is the template for instances.
+// ok is false for remote dependencies.
+func declaredName(dep string) (name string, ok bool) {
+	name = dep
+	if template, _, isInstance := parse.ParseInstance(dep); isInstance {
+		name = template
+	}
+	return name, !strings.Contains(name, ":")
+}
+
+// missingDeps reports local dependencies that aren't declared, and instances of templates that don't match them.
+func (l *linter) missingDeps() {
+	for _, r := range l.config.Recipes {
+		for _, ins := range r.Installers {
+			for i, dep := range ins.Dependencies {
+				name, ok := declaredName(dep)
+				if !ok {
+					continue
+				}
+				pos := r.Source
+				if i < len(ins.DependencySources) {
+					pos = ins.DependencySources[i]
+				}
+				decls, ok := l.recipes[name]
+				if !ok {
+					l.report(pos, Error, "missing-dep", "%v depends on %v, which isn't declared", r.Name, dep)
+					continue
+				}
+				params := decls[0].Params
+				_, args, isInstance := parse.ParseInstance(dep)
+				switch {
+				case isInstance && params == nil:
+					l.report(pos, Error, "missing-dep", "%v depends on an instance of %v, which isn't a template", r.Name, name)
+				case isInstance && len(args) != len(params):
+					l.report(pos, Error, "missing-dep", "%v depends on %v, but %v takes %d args", r.Name, dep, name, len(params))
+				case !isInstance && params != nil:
+					l.report(pos, Error, "missing-dep", "%v depends on the template %v rather than an instance of it", r.Name, name)
+				}
+			}
+		}
+	}
+}
+
+// shadowedInstallers reports installers that can never be selected,
+// since an installer before them has no dependencies and is always selected.
+func (l *linter) shadowedInstallers() {
+	for _, r := range l.config.Recipes {
+		for i, ins := range r.Installers {
+			// Package managers are only selected where they're available.
+			if len(ins.Dependencies) > 0 || ins.Manager != "" {
+				continue
+			}
+			for _, later := range r.Installers[i+1:] {
+				l.report(later.Source, Warning, "unreachable", "installer %v of %v is never used, since %v has no dependencies",
+					later.Name, r.Name, ins.FQDN(r))
+			}
+			break
+		}
+	}
+}
+
+// missingChecks reports recipes that install without a check, so they install again every time.
+// Packages recipes check each of their packages.
+func (l *linter) missingChecks() {
+	for _, r := range l.config.Recipes {
+		if r.Check != "" || r.Packages != nil {
+			continue
+		}
+		for _, ins := range r.Installers {
+			if ins.Script != "" {
+				l.report(r.Source, Warning, "no-check", "%v has no check, so it's installed on every run", r.Name)
+				break
+			}
+		}
+	}
+}
+
+// conditions reports when conditions on facts that don't exist, or with malformed patterns.
+// They'd otherwise only fail once the recipe is installed.
+func (l *linter) conditions() {
+	known := make(map[string]bool)
+	for _, name := range facts.Names {
+		known[name] = true
+	}
+	check := func(r parse.Recipe, pos parse.Pos, when parse.When) {
+		names := make([]string, 0, len(when))
+		for name := range when {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !known[name] {
+				l.report(pos, Error, "when", "%v depends on unknown fact %q", r.Name, name)
+				continue
+			}
+			for _, pattern := range when[name] {
+				if _, err := path.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+					l.report(pos, Error, "when", "%v has a malformed pattern %q for %v", r.Name, pattern, name)
+				}
+			}
+		}
+	}
+	for _, r := range l.config.Recipes {
+		check(r, r.Source, r.When)
+		for _, ins := range r.Installers {
+			check(r, ins.Source, ins.When)
+		}
+	}
+}
+
+// unreachable reports recipes that none of the targets depend on.
+func (l *linter) unreachable(targets []string) {
+	if len(targets) == 0 {
+		return
+	}
+	reached := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if reached[name] {
+			return
+		}
+		reached[name] = true
+		for _, r := range l.recipes[name] {
+			for _, ins := range r.Installers {
+				for _, dep := range ins.Dependencies {
+					if name, ok := declaredName(dep); ok {
+						visit(name)
+					}
+				}
+			}
+		}
+	}
+	for _, target := range targets {
+		if name, ok := declaredName(target); ok {
+			visit(name)
+		}
+	}
+
+	for _, r := range l.config.Recipes {
+		if !reached[r.Name] {
+			l.report(r.Source, Warning, "unreachable", "%v isn't reached from the targets", r.Name)
+		}
+	}
+}
+
+// validate reports the problems found by graph validation, such as build_only recipes that depend on local_only ones.
+func (l *linter) validate(grp graph.RecipeIndex) {
+	err := grp.Validate()
+	if err == nil {
+		return
+	}
+	errs, ok := err.(graph.ValidationErrors)
+	if !ok {
+		errs = graph.ValidationErrors{err}
+	}
+	for _, err := range errs {
+		var pos parse.Pos
+		if perr, ok := err.(*parse.Error); ok {
+			pos, err = perr.Pos, perr.Err
+		}
+		l.report(pos, Error, "invalid", "%v", err)
+	}
+}
+
+// syntax reports scripts that the shell can't parse.
+func (l *linter) syntax(ctx context.Context, shell string) {
+	check := func(pos parse.Pos, what, script string) {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, shell, "-n", "-c", script)
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if _, ok := err.(*exec.ExitError); ok {
+			l.report(pos, Error, "syntax", "%v: %v", what, strings.TrimSpace(stderr.String()))
+		} else if err != nil {
+			l.report(pos, Error, "syntax", "%v: %v", what, err)
+		}
+	}
+	for _, r := range l.config.Recipes {
+		if r.Check != "" {
+			check(r.Source, "check of "+r.Name, r.Check)
+		}
+		for _, ins := range r.Installers {
+			if ins.Script != "" {
+				check(ins.Source, "install script of "+ins.FQDN(r), ins.Script)
+			}
+		}
+	}
+}
+
+// Failed returns whether the problems should fail a lint run.
+// Warnings only fail it if strict is set.
+func Failed(problems []Problem, strict bool) bool {
+	for _, p := range problems {
+		if p.Severity == Error || strict {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package lint
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/graph"
+	"cdr.dev/nfy/internal/parse"
+	"cdr.dev/nfy/internal/runner"
+)
+
+const rootConfig = `import:
+  - tools.yml
+htop:
+  install: "apt-get install -y htop"
+  check: "htop -h"
+  deps:
+    - apt
+    - aptt
+wget:
+  check: "wget -h"
+  install_any:
+    script: "curl -sSfLO https://example.com/wget"
+  install_brew:
+    script: "brew install wget"
+    deps:
+      - brew
+apt:
+  check: "apt-get -h"
+fonts:
+  install: "touch /fonts"
+  check: "test -e /fonts"
+  local_only: true
+image-fonts:
+  install: "if true; then echo"
+  check: "true"
+  build_only: true
+  deps:
+    - fonts
+`
+
+const toolsConfig = `htop:
+  install: "brew install htop"
+  check: "htop -h"
+jq:
+  install: "apt-get install -y jq"
+  when:
+    platform: linux
+apt-pkg:
+  params: [name]
+  check: "{{ .Params.name }} -h"
+  install: "apt-get install -y {{ .Params.name }}"
+tools:
+  deps:
+    - apt-pkg(curl)
+    - apt-pkg(curl, 8)
+    - apt-pkg
+    - jq(1)
+unused:
+  check: "true"
+`
+
+func TestLint(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "nfy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, body := range map[string]string{"nfy.yml": rootConfig, "tools.yml": toolsConfig} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var config parse.Result
+	err = parse.Traverse(&config, filepath.Join(dir, "nfy.yml"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	grp, err := graph.Generate(runner.FromParseRecipes(config.Recipes, ""), graph.RemoteConfig{})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	problems := Lint(context.Background(), &config, grp, Options{Targets: []string{"htop", "wget", "image-fonts", "tools"}})
+	var got []string
+	for _, p := range problems {
+		if p.Check == "syntax" {
+			// The message depends on the shell.
+			p.Message = p.Message[:strings.Index(p.Message, ":")]
+		}
+		got = append(got, strings.Replace(p.String(), dir+string(filepath.Separator), "", -1))
+	}
+	want := []string{
+		"nfy.yml:8:7: error: htop depends on aptt, which isn't declared (missing-dep)",
+		"nfy.yml:13:3: warning: installer brew of wget is never used, since wget [any] has no dependencies (unreachable)",
+		"nfy.yml:16:9: error: wget depends on brew, which isn't declared (missing-dep)",
+		"nfy.yml:23:1: error: image-fonts is build_only but depends on local_only fonts (invalid)",
+		"nfy.yml:24:3: error: install script of image-fonts (syntax)",
+		"tools.yml:1:1: error: htop is already declared at nfy.yml:3:1 (duplicate)",
+		"tools.yml:4:1: warning: jq has no check, so it's installed on every run (no-check)",
+		"tools.yml:4:1: error: jq depends on unknown fact \"platform\" (when)",
+		"tools.yml:15:7: error: tools depends on apt-pkg(curl, 8), but apt-pkg takes 1 args (missing-dep)",
+		"tools.yml:16:7: error: tools depends on the template apt-pkg rather than an instance of it (missing-dep)",
+		"tools.yml:17:7: error: tools depends on an instance of jq, which isn't a template (missing-dep)",
+		"tools.yml:18:1: warning: unused isn't reached from the targets (unreachable)",
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("unexpected problems: %v", cmp.Diff(want, got))
+	}
+	if !Failed(problems, false) {
+		t.Errorf("expected errors to fail the run")
+	}
+}
@@ -0,0 +1,2 @@
+// Package packages knows how to drive the package managers that packages recipes install with.
+package packages
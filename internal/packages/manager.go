@@ -0,0 +1,127 @@
+package packages
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Manager describes how to drive a package manager from the shell.
+type Manager struct {
+	Name string
+	// Available is a check for whether the manager can be used.
+	Available string
+	// installed checks whether the package in %s is installed.
+	installed string
+	// install installs the packages that follow it.
+	install string
+	// pins are the characters that start the version or release a package is pinned to, as in htop=3.2.
+	// installed is given the package's name without them, since it only knows packages by name.
+	pins string
+}
+
+var managers = []Manager{
+	{
+		Name:      "apt",
+		Available: "command -v apt-get",
+		installed: "dpkg-query -W -f='${Status}' %s 2>/dev/null | grep -q 'ok installed'",
+		install:   "DEBIAN_FRONTEND=noninteractive apt-get install -y",
+		pins:      "=/",
+	},
+	// rpm knows name-version, as dnf and yum pin packages, but not the name=version of zypper.
+	{Name: "dnf", Available: "command -v dnf", installed: "rpm -q %s", install: "dnf install -y", pins: "="},
+	{Name: "yum", Available: "command -v yum", installed: "rpm -q %s", install: "yum install -y", pins: "="},
+	{Name: "zypper", Available: "command -v zypper", installed: "rpm -q %s", install: "zypper --non-interactive install", pins: "="},
+	{Name: "apk", Available: "command -v apk", installed: "apk info -e %s", install: "apk add --no-cache", pins: "=~"},
+	{Name: "pacman", Available: "command -v pacman", installed: "pacman -Q %s", install: "pacman -S --noconfirm --needed", pins: "="},
+	// Versioned formulae, such as python@3.12, are packages of their own.
+	{Name: "brew", Available: "command -v brew", installed: "brew list --versions %s", install: "brew install"},
+}
+
+// Lookup returns the manager with the given name.
+func Lookup(name string) (Manager, bool) {
+	for _, m := range managers {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Manager{}, false
+}
+
+// Names returns the names of the supported managers.
+func Names() []string {
+	names := make([]string, len(managers))
+	for i, m := range managers {
+		names[i] = m.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validName matches package names, including versions and taps such as htop=3.2 or user/tap/formula,
+// that are safe to use unquoted in scripts.
+var validName = regexp.MustCompile(`^[\w@.+:=/~-]+$`)
+
+// ValidName returns whether pkg can be used as a package name.
+func ValidName(pkg string) bool {
+	return validName.MatchString(pkg)
+}
+
+// Installed returns a check for whether pkg is installed.
+// A pinned package counts as installed whatever its version.
+func (m Manager) Installed(pkg string) string {
+	if i := strings.IndexAny(pkg, m.pins); i > 0 {
+		pkg = pkg[:i]
+	}
+	return fmt.Sprintf(m.installed, pkg) + " >/dev/null 2>&1"
+}
+
+// Check returns a check for whether all of pkgs are installed.
+func (m Manager) Check(pkgs []string) string {
+	checks := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		checks[i] = m.Installed(pkg)
+	}
+	return strings.Join(checks, " && ")
+}
+
+// Install returns a command that installs pkgs.
+func (m Manager) Install(pkgs []string) string {
+	return m.install + " " + strings.Join(pkgs, " ")
+}
+
+// Missing returns a script that prints the packages of pkgs that aren't installed, one per line.
+func (m Manager) Missing(pkgs []string) string {
+	lines := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		lines[i] = fmt.Sprintf("%s || echo %s", m.Installed(pkg), pkg)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// InstallMissing returns a command that installs the packages of pkgs that aren't installed yet,
+// with a single run of the manager.
+func (m Manager) InstallMissing(pkgs []string) string {
+	parts := []string{"missing="}
+	for _, pkg := range pkgs {
+		parts = append(parts, fmt.Sprintf(`%s || missing="$missing %s"`, m.Installed(pkg), pkg))
+	}
+	parts = append(parts, fmt.Sprintf(`[ -z "$missing" ] || %s $missing`, m.install))
+	return strings.Join(parts, "; ")
+}
+
+// Merge returns the packages of each list in order, without repeating any.
+func Merge(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	var pkgs []string
+	for _, list := range lists {
+		for _, pkg := range list {
+			if !seen[pkg] {
+				seen[pkg] = true
+				pkgs = append(pkgs, pkg)
+			}
+		}
+	}
+	return pkgs
+}
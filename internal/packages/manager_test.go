@@ -0,0 +1,166 @@
+package packages
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestValidName(t *testing.T) {
+	t.Parallel()
+
+	for name, want := range map[string]bool{
+		"htop":                 true,
+		"python3.12":           true,
+		"htop=3.2.2-2":         true,
+		"libstdc++6":           true,
+		"homebrew/cask/iterm2": true,
+		"":                     false,
+		"htop wget":            false,
+		"htop;reboot":          false,
+		"$(reboot)":            false,
+	} {
+		if got := ValidName(name); got != want {
+			t.Errorf("ValidName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	t.Parallel()
+
+	got := Merge([]string{"htop", "wget"}, nil, []string{"vim", "htop"}, []string{"wget", "jq"})
+	want := []string{"htop", "wget", "vim", "jq"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("unexpected packages: %v", cmp.Diff(want, got))
+	}
+}
+
+// fakeBrew stands in for brew. Packages are installed by creating a file named after them in $STATE,
+// and each install is logged to $STATE/log.
+const fakeBrew = `#!/bin/sh
+case "$1" in
+list) test -e "$STATE/$3" ;;
+install) shift; echo "$*" >> "$STATE/log"; for pkg; do touch "$STATE/$pkg"; done ;;
+esac
+`
+
+func TestScripts(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "nfy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "brew"), []byte(fakeBrew), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "htop"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(script string) (string, error) {
+		cmd := exec.Command("sh", "-c", script)
+		cmd.Env = append(os.Environ(), "PATH="+dir+string(filepath.ListSeparator)+os.Getenv("PATH"), "STATE="+dir)
+		out, err := cmd.Output()
+		return string(out), err
+	}
+
+	brew, _ := Lookup("brew")
+	pkgs := []string{"htop", "wget", "jq"}
+	missing, err := run(brew.Missing(pkgs))
+	if err != nil {
+		t.Fatalf("missing: %v", err)
+	}
+	if missing != "wget\njq\n" {
+		t.Errorf("got missing packages %q", missing)
+	}
+	if _, err := run(brew.Check(pkgs)); err == nil {
+		t.Errorf("check passed with missing packages")
+	}
+
+	// Only the missing packages are installed, with one run of brew.
+	_, err = run(brew.InstallMissing(pkgs))
+	if err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	_, err = run(brew.InstallMissing(pkgs))
+	if err != nil {
+		t.Fatalf("install again: %v", err)
+	}
+	log, err := ioutil.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(log) != "wget jq\n" {
+		t.Errorf("unexpected installs %q", log)
+	}
+	if _, err := run(brew.Check(pkgs)); err != nil {
+		t.Errorf("check failed after installing: %v", err)
+	}
+}
+
+func TestInstalledPinned(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		manager, pkg, want string
+	}{
+		{"apt", "htop=3.2.2-2", "dpkg-query -W -f='${Status}' htop 2>/dev/null | grep -q 'ok installed' >/dev/null 2>&1"},
+		{"apt", "htop/bookworm-backports", "dpkg-query -W -f='${Status}' htop 2>/dev/null | grep -q 'ok installed' >/dev/null 2>&1"},
+		{"apt", "libc6:amd64", "dpkg-query -W -f='${Status}' libc6:amd64 2>/dev/null | grep -q 'ok installed' >/dev/null 2>&1"},
+		{"dnf", "htop-3.2.2", "rpm -q htop-3.2.2 >/dev/null 2>&1"},
+		{"zypper", "htop=3.2.2", "rpm -q htop >/dev/null 2>&1"},
+		{"apk", "htop=3.2.2-r1", "apk info -e htop >/dev/null 2>&1"},
+		{"apk", "htop~3.2", "apk info -e htop >/dev/null 2>&1"},
+		{"pacman", "htop=3.2.2", "pacman -Q htop >/dev/null 2>&1"},
+		{"brew", "python@3.12", "brew list --versions python@3.12 >/dev/null 2>&1"},
+	} {
+		m, _ := Lookup(tc.manager)
+		if got := m.Installed(tc.pkg); got != tc.want {
+			t.Errorf("%v: Installed(%q) = %q, want %q", tc.manager, tc.pkg, got, tc.want)
+		}
+	}
+}
+
+// fakeDpkgQuery stands in for dpkg-query, with the packages named by the files in $STATE installed.
+const fakeDpkgQuery = `#!/bin/sh
+for pkg; do :; done
+test -e "$STATE/$pkg" && echo 'install ok installed'
+`
+
+// TestPinnedInstalled checks that pinned packages aren't installed again once they are.
+func TestPinnedInstalled(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "nfy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "dpkg-query"), []byte(fakeDpkgQuery), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "htop"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apt, _ := Lookup("apt")
+	cmd := exec.Command("sh", "-c", apt.Missing([]string{"htop=3.2.2-2", "wget=1.21.3-1"}))
+	cmd.Env = append(os.Environ(), "PATH="+dir+string(filepath.ListSeparator)+os.Getenv("PATH"), "STATE="+dir)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("missing: %v", err)
+	}
+	if string(out) != "wget=1.21.3-1\n" {
+		t.Errorf("got missing packages %q", out)
+	}
+}
@@ -6,15 +6,75 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"unicode"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+
+	"cdr.dev/nfy/internal/packages"
 )
 
+// Pos is a position in a config file.
+type Pos struct {
+	// File is empty if the config wasn't read from a file.
+	File string
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// IsValid returns whether the position is known.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+// Error is an error at a position in a config file.
+type Error struct {
+	Pos Pos
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Pos.String() + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Errorf returns an error at pos, or a plain error if pos isn't known.
+func Errorf(pos Pos, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if !pos.IsValid() {
+		return err
+	}
+	return &Error{Pos: pos, Err: err}
+}
+
+// When lists the facts a system must have for a recipe or installer to apply, by fact name.
+// A fact matches if it has one of the values, which may be glob patterns.
+// Values starting with "!" exclude systems whose fact matches them instead.
+type When map[string][]string
+
 type Installer struct {
 	// Name identifies the installer when multiple are provided.
 	Name         string
 	Script       string
 	Dependencies []string
+	When         When
+	// Manager is the package manager that installs Packages, for the installers of packages recipes.
+	// Script installs all of them.
+	Manager  string
+	Packages []string
+	// Source is where the installer is declared.
+	Source Pos
+	// DependencySources are where each of the Dependencies is declared.
+	DependencySources []Pos
 }
 
 func (i Installer) FQDN(r Recipe) string {
@@ -28,42 +88,224 @@ type Recipe struct {
 	Name       string
 	Check      string
 	BuildOnly  bool
+	LocalOnly  bool
 	Comment    string
 	Installers []Installer
+	// CacheDirs are directories that persist between image builds, such as package manager caches.
+	// They're ignored by local installs.
+	CacheDirs []string
+	When      When
+	// Params make the recipe a template, which is only installed through instances that give the params values,
+	// such as name(value) for a template with a single param.
+	Params []string
+	// ForEach lists the args of instances to install along with the other recipes.
+	ForEach [][]string
+	// Args are the values of the params of a template's instance, by param.
+	Args map[string]string
+	// Packages lists the packages to install with each package manager, in the order the managers are tried.
+	// The recipe has an installer for each manager instead of scripts.
+	Packages []PackageList
+	// Source is where the recipe is declared.
+	Source Pos
+}
+
+// PackageList is a list of packages to install with a package manager.
+type PackageList struct {
+	Manager string
+	Names   []string
+	// Source is where the list is declared.
+	Source Pos
+}
+
+// InstanceName returns the name of the instance of template with args.
+func InstanceName(template string, args []string) string {
+	return template + "(" + strings.Join(args, ", ") + ")"
+}
+
+// ParseInstance splits the name of a template's instance, such as "apt-pkg(htop)", into the name of the template
+// and the args. ok is false if name doesn't name an instance.
+func ParseInstance(name string) (template string, args []string, ok bool) {
+	open := strings.Index(name, "(")
+	if open <= 0 || !strings.HasSuffix(name, ")") {
+		return "", nil, false
+	}
+	for _, arg := range strings.Split(name[open+1:len(name)-1], ",") {
+		args = append(args, strings.TrimSpace(arg))
+	}
+	return name[:open], args, true
 }
 
 type Result struct {
 	Imports []string
-	Recipes []Recipe
+	// ImportSources are where each of the Imports is declared.
+	ImportSources []Pos
+	Recipes       []Recipe
+	// BuildPrefer maps base images to the installers preferred when building them.
+	// The preferences under the empty key apply to every base.
+	BuildPrefer map[string][]string
+	// Vars are values that scripts can refer to as {{ .Vars.NAME }}.
+	Vars map[string]string
+}
+
+// parser keeps track of the file being parsed, for positions.
+type parser struct {
+	file string
+}
+
+func (p *parser) pos(n *yaml.Node) Pos {
+	return Pos{File: p.file, Line: n.Line, Col: n.Column}
+}
+
+func (p *parser) errorf(n *yaml.Node, format string, args ...interface{}) error {
+	return &Error{Pos: p.pos(n), Err: fmt.Errorf(format, args...)}
+}
+
+func (p *parser) expectError(n *yaml.Node, field, typ string) error {
+	return p.errorf(n, "expected %q to be %q", field, typ)
+}
+
+// str returns the value of a string scalar.
+func (p *parser) str(n *yaml.Node, field string) (string, error) {
+	if n.Kind != yaml.ScalarNode || n.ShortTag() != "!!str" {
+		return "", p.expectError(n, field, "string")
+	}
+	return n.Value, nil
+}
+
+// yaml11Bools are the booleans of YAML 1.1, which configs used to be parsed with, that YAML 1.2 reads as strings.
+var yaml11Bools = map[string]bool{
+	"y": true, "Y": true, "yes": true, "Yes": true, "YES": true, "on": true, "On": true, "ON": true,
+	"n": false, "N": false, "no": false, "No": false, "NO": false, "off": false, "Off": false, "OFF": false,
+}
+
+// bool returns the value of a boolean scalar. Unquoted YAML 1.1 booleans, such as yes, are accepted too.
+func (p *parser) bool(n *yaml.Node, field string) (bool, error) {
+	if n.Kind == yaml.ScalarNode && n.Style == 0 {
+		if b, ok := yaml11Bools[n.Value]; ok {
+			return b, nil
+		}
+	}
+	var b bool
+	if n.Kind != yaml.ScalarNode || n.ShortTag() != "!!bool" || n.Decode(&b) != nil {
+		return false, p.expectError(n, field, "bool")
+	}
+	return b, nil
+}
+
+// resolve follows aliases to the node they refer to.
+func resolve(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// pairs returns the key and value nodes of a mapping.
+func pairs(n *yaml.Node) [][2]*yaml.Node {
+	var kvs [][2]*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		kvs = append(kvs, [2]*yaml.Node{n.Content[i], resolve(n.Content[i+1])})
+	}
+	return kvs
+}
+
+func (p *parser) parseDependencies(n *yaml.Node) ([]string, []Pos, error) {
+	deps, err := p.parseStrings("deps", n)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sources []Pos
+	for _, it := range n.Content {
+		sources = append(sources, p.pos(it))
+	}
+	return deps, sources, nil
+}
+
+func (p *parser) parseStrings(field string, n *yaml.Node) ([]string, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, p.expectError(n, field, "array")
+	}
+	var ss []string
+	for _, it := range n.Content {
+		it = resolve(it)
+		if it.Kind != yaml.ScalarNode {
+			return nil, p.expectError(it, field+" item", "scalar")
+		}
+		ss = append(ss, it.Value)
+	}
+	return ss, nil
+}
+
+// parseWhen parses a map of fact names to a value or a list of values.
+func (p *parser) parseWhen(n *yaml.Node) (When, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, p.expectError(n, "when", "map")
+	}
+	when := make(When)
+	for _, it := range pairs(n) {
+		fact := it[0].Value
+		if it[1].Kind == yaml.ScalarNode {
+			when[fact] = []string{it[1].Value}
+			continue
+		}
+		values, err := p.parseStrings("when."+fact, it[1])
+		if err != nil {
+			return nil, err
+		}
+		when[fact] = values
+	}
+	return when, nil
 }
 
-func expectError(field, typ string) error {
-	return fmt.Errorf("expected %q to be %q", field, typ)
+// parseVars parses a map of variable names to scalar values.
+func (p *parser) parseVars(n *yaml.Node) (map[string]string, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, p.expectError(n, "vars", "map")
+	}
+	vars := make(map[string]string)
+	for _, it := range pairs(n) {
+		name := it[0].Value
+		if it[1].Kind != yaml.ScalarNode {
+			return nil, p.expectError(it[1], "vars."+name, "string")
+		}
+		vars[name] = it[1].Value
+	}
+	return vars, nil
 }
 
-func parseDependencies(v interface{}) ([]string, error) {
-	deps, ok := v.([]interface{})
-	if !ok {
-		return nil, expectError("deps", "array")
+// parseBuildPrefer accepts either a list of installers, or a map of base images to lists of installers.
+func (p *parser) parseBuildPrefer(n *yaml.Node) (map[string][]string, error) {
+	prefs := make(map[string][]string)
+	if n.Kind == yaml.MappingNode {
+		for _, it := range pairs(n) {
+			base := it[0].Value
+			names, err := p.parseStrings("build_prefer."+base, it[1])
+			if err != nil {
+				return nil, err
+			}
+			prefs[base] = names
+		}
+		return prefs, nil
 	}
-	var ds []string
-	for _, dep := range deps {
-		ds = append(ds, fmt.Sprint(dep))
+	names, err := p.parseStrings("build_prefer", n)
+	if err != nil {
+		return nil, err
 	}
-	return ds, nil
+	prefs[""] = names
+	return prefs, nil
 }
 
-func parseRecipe(key string, val yaml.MapSlice) (Recipe, error) {
+func (p *parser) parseRecipe(keyNode, val *yaml.Node) (Recipe, error) {
 	// overloaded is true
 	var overloaded bool
 
-	var r Recipe
-	var ok bool
-	for _, it := range val {
-		key := fmt.Sprint(it.Key)
+	r := Recipe{Source: p.pos(keyNode)}
+	var err error
+	for _, it := range pairs(val) {
+		key := it[0].Value
 		switch {
 		case strings.HasPrefix(key, "install"):
-			var installer Installer
+			installer := Installer{Source: p.pos(it[0])}
 			const splitChar = "_"
 			if tok := strings.Split(key, splitChar); len(tok) == 2 {
 				overloaded = true
@@ -72,115 +314,295 @@ func parseRecipe(key string, val yaml.MapSlice) (Recipe, error) {
 
 			// Simple path
 			if !overloaded {
-				installer.Script, ok = it.Value.(string)
-				if !ok {
-					return r, expectError("install", "string")
+				installer.Script, err = p.str(it[1], "install")
+				if err != nil {
+					return r, err
 				}
 				r.Installers = append(r.Installers, installer)
 				continue
 			}
 
 			// Parse out overloaded dependencies.
-			args, ok := it.Value.(yaml.MapSlice)
-			if !ok {
-				return r, expectError(key+".deps", "MapSlice")
+			if it[1].Kind != yaml.MappingNode {
+				return r, p.expectError(it[1], key+".deps", "MapSlice")
 			}
-			for _, it := range args {
-				switch it.Key {
+			for _, it := range pairs(it[1]) {
+				switch it[0].Value {
 				case "deps":
-					var err error
-					installer.Dependencies, err = parseDependencies(it.Value)
+					installer.Dependencies, installer.DependencySources, err = p.parseDependencies(it[1])
 					if err != nil {
 						return r, err
 					}
 				case "script":
-					installer.Script, ok = it.Value.(string)
-					if !ok {
-						return r, expectError("script", "string")
+					installer.Script, err = p.str(it[1], "script")
+					if err != nil {
+						return r, err
+					}
+				case "when":
+					installer.When, err = p.parseWhen(it[1])
+					if err != nil {
+						return r, err
 					}
 				default:
-					return r, fmt.Errorf("overloaded target has unexpected key %q", it.Key)
+					return r, p.errorf(it[0], "overloaded target has unexpected key %q", it[0].Value)
 				}
 			}
 			r.Installers = append(r.Installers, installer)
 
 		case key == "check":
-			r.Check, ok = it.Value.(string)
-			if !ok {
-				return r, expectError("check", "string")
+			r.Check, err = p.str(it[1], "check")
+			if err != nil {
+				return r, err
 			}
 		case key == "build_only":
-			r.BuildOnly, ok = it.Value.(bool)
-			if !ok {
-				return r, expectError("build_only", "bool")
+			r.BuildOnly, err = p.bool(it[1], "build_only")
+			if err != nil {
+				return r, err
+			}
+		case key == "local_only":
+			r.LocalOnly, err = p.bool(it[1], "local_only")
+			if err != nil {
+				return r, err
+			}
+		case key == "cache_dirs":
+			r.CacheDirs, err = p.parseStrings("cache_dirs", it[1])
+			if err != nil {
+				return r, err
+			}
+			for i, dir := range r.CacheDirs {
+				if !strings.HasPrefix(dir, "/") && dir != "~" && !strings.HasPrefix(dir, "~/") {
+					return r, p.errorf(it[1].Content[i], "cache_dirs must be absolute or start with ~, got %q", dir)
+				}
+			}
+		case key == "when":
+			r.When, err = p.parseWhen(it[1])
+			if err != nil {
+				return r, err
+			}
+		case key == "params":
+			r.Params, err = p.parseStrings("params", it[1])
+			if err != nil {
+				return r, err
+			}
+			seen := make(map[string]bool)
+			for i, param := range r.Params {
+				if !isIdentifier(param) || seen[param] {
+					return r, p.errorf(it[1].Content[i], "param %q must be a unique identifier", param)
+				}
+				seen[param] = true
+			}
+		case key == "for_each":
+			r.ForEach, err = p.parseForEach(it[1])
+			if err != nil {
+				return r, err
+			}
+		case key == "packages":
+			r.Packages, err = p.parsePackages(it[1])
+			if err != nil {
+				return r, err
 			}
 		case key == "comment":
-			r.Comment, ok = it.Value.(string)
-			if !ok {
-				return r, expectError("comment", "string")
+			r.Comment, err = p.str(it[1], "comment")
+			if err != nil {
+				return r, err
 			}
 		case key == "deps":
 			switch {
 			case len(r.Installers) > 1:
-				return r, fmt.Errorf("if the target is overloaded, deps must be provided per installer")
+				return r, p.errorf(it[0], "if the target is overloaded, deps must be provided per installer")
 			default:
-				var err error
 				// Add an inert install. This is a depedency proxy.
 				if len(r.Installers) == 0 {
-					r.Installers = append(r.Installers, Installer{})
+					r.Installers = append(r.Installers, Installer{Source: p.pos(it[0])})
 				}
-				r.Installers[0].Dependencies, err = parseDependencies(it.Value)
+				r.Installers[0].Dependencies, r.Installers[0].DependencySources, err = p.parseDependencies(it[1])
 				if err != nil {
 					return r, err
 				}
 			}
 		default:
-			return r, fmt.Errorf("unexpected directive %q", it.Key)
+			return r, p.errorf(it[0], "unexpected directive %q", key)
+		}
+	}
+	if r.BuildOnly && r.LocalOnly {
+		return r, p.errorf(keyNode, "build_only and local_only are mutually exclusive")
+	}
+	if r.Packages != nil {
+		err = p.packageInstallers(&r, keyNode)
+		if err != nil {
+			return r, err
+		}
+	}
+	if strings.ContainsAny(keyNode.Value, "()") {
+		return r, p.errorf(keyNode, "recipe names can't contain parentheses, which instantiate templates")
+	}
+	if r.ForEach != nil && r.Params == nil {
+		return r, p.errorf(keyNode, "for_each requires params")
+	}
+	for i, args := range r.ForEach {
+		if len(args) != len(r.Params) {
+			return r, p.errorf(keyNode, "for_each item %d has %d args, but there are %d params", i+1, len(args), len(r.Params))
 		}
 	}
-	r.Name = key
+	r.Name = keyNode.Value
 	return r, nil
 }
 
+// parsePackages parses a map of package managers to lists of packages.
+func (p *parser) parsePackages(n *yaml.Node) ([]PackageList, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, p.expectError(n, "packages", "map")
+	}
+	var lists []PackageList
+	for _, it := range pairs(n) {
+		manager := it[0].Value
+		if _, ok := packages.Lookup(manager); !ok {
+			return nil, p.errorf(it[0], "unknown package manager %q, expected one of %s", manager, strings.Join(packages.Names(), ", "))
+		}
+		names, err := p.parseStrings("packages."+manager, it[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, p.errorf(it[1], "packages.%s must list at least one package", manager)
+		}
+		for i, name := range names {
+			if !packages.ValidName(name) {
+				return nil, p.errorf(it[1].Content[i], "invalid package name %q", name)
+			}
+		}
+		lists = append(lists, PackageList{Manager: manager, Names: names, Source: p.pos(it[0])})
+	}
+	if len(lists) == 0 {
+		return nil, p.errorf(n, "packages must list the packages of at least one package manager")
+	}
+	return lists, nil
+}
+
+// packageInstallers replaces the installers of a packages recipe with one for each manager.
+// Its deps apply to every manager.
+func (p *parser) packageInstallers(r *Recipe, keyNode *yaml.Node) error {
+	var deps Installer
+	for _, ins := range r.Installers {
+		if ins.Script != "" || ins.Name != "" {
+			return p.errorf(keyNode, "packages can't be combined with install")
+		}
+		deps = ins
+	}
+	if r.Check != "" {
+		return p.errorf(keyNode, "packages are checked individually, so there can't be a check")
+	}
+	r.Installers = nil
+	for _, list := range r.Packages {
+		m, _ := packages.Lookup(list.Manager)
+		r.Installers = append(r.Installers, Installer{
+			Name:              list.Manager,
+			Script:            m.Install(list.Names),
+			Dependencies:      deps.Dependencies,
+			DependencySources: deps.DependencySources,
+			Manager:           list.Manager,
+			Packages:          list.Names,
+			Source:            list.Source,
+		})
+	}
+	return nil
+}
+
+// parseForEach parses a list of instances' args. A scalar item is the only arg of an instance.
+func (p *parser) parseForEach(n *yaml.Node) ([][]string, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, p.expectError(n, "for_each", "array")
+	}
+	var items [][]string
+	for _, it := range n.Content {
+		it = resolve(it)
+		if it.Kind == yaml.ScalarNode {
+			items = append(items, []string{it.Value})
+			continue
+		}
+		args, err := p.parseStrings("for_each item", it)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, args)
+	}
+	return items, nil
+}
+
+func isIdentifier(s string) bool {
+	for i, c := range s {
+		if c != '_' && !unicode.IsLetter(c) && (i == 0 || !unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
 // Parse parses a recipe from a source file.
 func Parse(r io.Reader) (*Result, error) {
-	var items yaml.MapSlice
-	err := yaml.NewDecoder(r).Decode(&items)
+	return parse(r, "")
+}
+
+// parse parses a recipe from file, which is only used for positions.
+func parse(r io.Reader, file string) (*Result, error) {
+	p := &parser{file: file}
+	var doc yaml.Node
+	err := yaml.NewDecoder(r).Decode(&doc)
 	if err != nil {
 		if err == io.EOF {
 			return &Result{}, nil
 		}
+		if file != "" {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
 		return nil, err
 	}
+	if len(doc.Content) == 0 {
+		return &Result{}, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, p.errorf(root, "expected a map of recipes")
+	}
 
 	var rs Result
-	for _, item := range items {
-		if item.Key == nil {
-			return nil, fmt.Errorf("nil key? value: %+v", item.Value)
-		}
-		key, ok := item.Key.(string)
-		if !ok {
-			return nil, fmt.Errorf("%v is of type %T; we expect a string", item.Key, item.Key)
+	for _, item := range pairs(root) {
+		keyNode, val := item[0], item[1]
+		if keyNode.Kind != yaml.ScalarNode || keyNode.ShortTag() != "!!str" {
+			return nil, p.errorf(keyNode, "%v is of type %v; we expect a string", keyNode.Value, keyNode.ShortTag())
 		}
+		key := keyNode.Value
 
 		switch key {
 		case "import":
-			arr, ok := item.Value.([]interface{})
-			if !ok {
-				return nil, fmt.Errorf("%v is of type %T, we expected a []interface{}", item.Value, item.Value)
+			if val.Kind != yaml.SequenceNode {
+				return nil, p.errorf(val, "import must be a list of paths")
+			}
+			for _, imp := range val.Content {
+				rs.Imports = append(rs.Imports, imp.Value)
+				rs.ImportSources = append(rs.ImportSources, p.pos(imp))
 			}
-			for _, imp := range arr {
-				rs.Imports = append(rs.Imports, fmt.Sprint(imp))
+		case "build_prefer":
+			rs.BuildPrefer, err = p.parseBuildPrefer(val)
+			if err != nil {
+				return nil, err
+			}
+		case "vars":
+			rs.Vars, err = p.parseVars(val)
+			if err != nil {
+				return nil, err
 			}
 		default:
 			// Recipe
-			val, ok := item.Value.(yaml.MapSlice)
-			if !ok {
-				return nil, fmt.Errorf("%v is of type %T, we expected a yaml.MapSlice", item.Value, item.Value)
+			if val.Kind != yaml.MappingNode {
+				return nil, p.errorf(val, "recipe %v must be a map", key)
 			}
 
-			recipe, err := parseRecipe(key, val)
+			recipe, err := p.parseRecipe(keyNode, val)
 			if err != nil {
+				if perr, ok := err.(*Error); ok {
+					return nil, &Error{Pos: perr.Pos, Err: fmt.Errorf("parsing %v failed: %w", key, perr.Err)}
+				}
 				return nil, fmt.Errorf("parsing %v failed: %w", key, err)
 			}
 			rs.Recipes = append(rs.Recipes, recipe)
@@ -190,24 +612,94 @@ func Parse(r io.Reader) (*Result, error) {
 	return &rs, nil
 }
 
-// Traverse parses the import tree in a directory.
-func Traverse(recipes *[]Recipe, path string) error {
-	fi, err := os.OpenFile(path, os.O_RDONLY, 0)
+// Traverse parses the import tree in a directory, accumulating the recipes of every file into res.
+// Settings such as build_prefer and vars are taken from the first file that declares them.
+// Files imported more than once are only parsed the first time, and import cycles are an error.
+// The Imports of res are left untouched.
+func Traverse(res *Result, path string) error {
+	t := &traversal{res: res, visited: make(map[string]bool)}
+	return t.file(path, Pos{})
+}
+
+// traversal tracks the files of an import tree.
+type traversal struct {
+	res *Result
+	// visited holds the canonical paths of the files parsed so far.
+	visited map[string]bool
+	// stack is the chain of imports that led to the current file.
+	stack []importedFile
+}
+
+type importedFile struct {
+	path      string
+	canonical string
+}
+
+// canonicalPath resolves path to an absolute path without symlinks, so that a file has a single name.
+func canonicalPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// file parses the file at path, which is imported at pos, and everything it imports.
+func (t *traversal) file(path string, pos Pos) error {
+	canonical, err := canonicalPath(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return fmt.Errorf("path=%s, no %s found", path, filepath.Base(path))
+			return Errorf(pos, "path=%s, no %s found", path, filepath.Base(path))
+		}
+		return Errorf(pos, "path=%s, %w", path, err)
+	}
+	for i, f := range t.stack {
+		if f.canonical != canonical {
+			continue
 		}
-		return fmt.Errorf("path=%s, %w", path, err)
+		var chain []string
+		for _, f := range t.stack[i:] {
+			chain = append(chain, f.path)
+		}
+		return Errorf(pos, "import cycle: %s -> %s", strings.Join(chain, " -> "), path)
+	}
+	if t.visited[canonical] {
+		return nil
+	}
+	t.visited[canonical] = true
+
+	fi, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return Errorf(pos, "path=%s, %w", path, err)
 	}
 	defer fi.Close()
 
-	res, err := Parse(fi)
+	file, err := parse(fi, path)
 	if err != nil {
 		return err
 	}
-	*recipes = append(*recipes, res.Recipes...)
+	res := t.res
+	res.Recipes = append(res.Recipes, file.Recipes...)
+	for base, names := range file.BuildPrefer {
+		if res.BuildPrefer == nil {
+			res.BuildPrefer = make(map[string][]string)
+		}
+		if _, ok := res.BuildPrefer[base]; !ok {
+			res.BuildPrefer[base] = names
+		}
+	}
+	for name, value := range file.Vars {
+		if res.Vars == nil {
+			res.Vars = make(map[string]string)
+		}
+		if _, ok := res.Vars[name]; !ok {
+			res.Vars[name] = value
+		}
+	}
 
-	for _, im := range res.Imports {
+	t.stack = append(t.stack, importedFile{path: path, canonical: canonical})
+	defer func() { t.stack = t.stack[:len(t.stack)-1] }()
+	for i, im := range file.Imports {
 		fullPath := filepath.Join(
 			filepath.Dir(path),
 			im,
@@ -215,11 +707,11 @@ func Traverse(recipes *[]Recipe, path string) error {
 
 		matches, err := filepath.Glob(fullPath)
 		if err != nil {
-			return fmt.Errorf("invalid path %q: %w", fullPath, err)
+			return Errorf(file.ImportSources[i], "invalid path %q: %w", fullPath, err)
 		}
 
 		for _, match := range matches {
-			err = Traverse(recipes, match)
+			err = t.file(match, file.ImportSources[i])
 			if err != nil {
 				return err
 			}
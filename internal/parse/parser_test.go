@@ -2,6 +2,10 @@ package parse
 
 import (
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -76,6 +80,305 @@ wget:
 				},
 			},
 		},
+		{
+			name: "LocalOnly",
+			body: `
+fonts:
+  install: "apt-get install -y fonts-firacode"
+  local_only: true
+`,
+			want: Result{
+				Recipes: []Recipe{
+					{
+						Name:      "fonts",
+						LocalOnly: true,
+						Installers: []Installer{
+							{
+								Script: "apt-get install -y fonts-firacode",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "CacheDirs",
+			body: `
+cargo:
+  install: "cargo install ripgrep"
+  cache_dirs:
+    - ~/.cargo/registry
+    - /var/cache/apt
+`,
+			want: Result{
+				Recipes: []Recipe{
+					{
+						Name:      "cargo",
+						CacheDirs: []string{"~/.cargo/registry", "/var/cache/apt"},
+						Installers: []Installer{
+							{
+								Script: "cargo install ripgrep",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "RelativeCacheDir",
+			body: `
+cargo:
+  install: "cargo install ripgrep"
+  cache_dirs:
+    - .cargo/registry
+`,
+			wantErr: anyError,
+		},
+		{
+			name: "When",
+			body: `
+htop:
+  when:
+    os: linux
+    distro: [ubuntu, "!alpine"]
+  install_apt:
+    script: "apt-get install -y htop"
+    when:
+      distro_like: debian
+`,
+			want: Result{
+				Recipes: []Recipe{
+					{
+						Name: "htop",
+						When: When{"os": {"linux"}, "distro": {"ubuntu", "!alpine"}},
+						Installers: []Installer{
+							{
+								Name:   "apt",
+								Script: "apt-get install -y htop",
+								When:   When{"distro_like": {"debian"}},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "Vars",
+			body: `
+vars:
+  CHANNEL: stable
+  RETRIES: 3
+`,
+			want: Result{
+				Vars: map[string]string{"CHANNEL": "stable", "RETRIES": "3"},
+			},
+		},
+		{
+			name: "Template",
+			body: `
+apt-pkg:
+  params: [name, version]
+  for_each:
+    - [htop, "3.2"]
+    - [jq, "1.6"]
+  check: "{{ .Params.name }} -h"
+  install: "apt-get install -y {{ .Params.name }}={{ .Params.version }}"
+`,
+			want: Result{
+				Recipes: []Recipe{
+					{
+						Name:    "apt-pkg",
+						Check:   "{{ .Params.name }} -h",
+						Params:  []string{"name", "version"},
+						ForEach: [][]string{{"htop", "3.2"}, {"jq", "1.6"}},
+						Installers: []Installer{
+							{Script: "apt-get install -y {{ .Params.name }}={{ .Params.version }}"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "ForEachArity",
+			body: `
+apt-pkg:
+  params: [name, version]
+  for_each: [htop]
+  install: "apt-get install -y {{ .Params.name }}={{ .Params.version }}"
+`,
+			wantErr: anyError,
+		},
+		{
+			name: "InstanceName",
+			body: `
+apt-pkg(htop):
+  install: "apt-get install -y htop"
+`,
+			wantErr: anyError,
+		},
+		{
+			// Configs were parsed as YAML 1.1, whose booleans include yes and off.
+			name: "YAML11Bools",
+			body: `
+fonts:
+  install: "apt-get install -y fonts-firacode"
+  build_only: yes
+  local_only: off
+`,
+			want: Result{
+				Recipes: []Recipe{
+					{
+						Name: "fonts",
+						Installers: []Installer{
+							{
+								Script: "apt-get install -y fonts-firacode",
+							},
+						},
+						BuildOnly: true,
+					},
+				},
+			},
+		},
+		{
+			name: "QuotedBool",
+			body: `
+fonts:
+  install: "apt-get install -y fonts-firacode"
+  build_only: "yes"
+`,
+			wantErr: anyError,
+		},
+		{
+			name: "BuildAndLocalOnly",
+			body: `
+fonts:
+  install: "apt-get install -y fonts-firacode"
+  build_only: true
+  local_only: true
+`,
+			wantErr: anyError,
+		},
+		{
+			name: "Packages",
+			body: `
+tools:
+  packages:
+    apt: [htop, wget]
+    brew: [htop]
+  deps:
+    - apt-update
+`,
+			want: Result{
+				Recipes: []Recipe{
+					{
+						Name: "tools",
+						Installers: []Installer{
+							{
+								Name:         "apt",
+								Script:       "DEBIAN_FRONTEND=noninteractive apt-get install -y htop wget",
+								Dependencies: []string{"apt-update"},
+								Manager:      "apt",
+								Packages:     []string{"htop", "wget"},
+							},
+							{
+								Name:         "brew",
+								Script:       "brew install htop",
+								Dependencies: []string{"apt-update"},
+								Manager:      "brew",
+								Packages:     []string{"htop"},
+							},
+						},
+						Packages: []PackageList{
+							{Manager: "apt", Names: []string{"htop", "wget"}},
+							{Manager: "brew", Names: []string{"htop"}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "PackagesUnknownManager",
+			body: `
+tools:
+  packages:
+    chocolatey: [htop]
+`,
+			wantErr: anyError,
+		},
+		{
+			name: "PackagesInvalidName",
+			body: `
+tools:
+  packages:
+    apt: ["htop; rm -rf /"]
+`,
+			wantErr: anyError,
+		},
+		{
+			name: "PackagesWithInstall",
+			body: `
+tools:
+  packages:
+    apt: [htop]
+  install: "apt-get install -y wget"
+`,
+			wantErr: anyError,
+		},
+		{
+			name: "PackagesWithCheck",
+			body: `
+tools:
+  packages:
+    apt: [htop]
+  check: "htop --version"
+`,
+			wantErr: anyError,
+		},
+		{
+			name: "BuildPreferList",
+			body: `
+build_prefer: [apt, apk]
+`,
+			want: Result{
+				BuildPrefer: map[string][]string{"": {"apt", "apk"}},
+			},
+		},
+		{
+			name: "BuildPreferByBase",
+			body: `
+build_prefer:
+  ubuntu: [apt]
+  alpine:
+    - apk
+`,
+			want: Result{
+				BuildPrefer: map[string][]string{"ubuntu": {"apt"}, "alpine": {"apk"}},
+			},
+		},
+		{
+			name: "BuildPreferScalar",
+			body: `
+build_prefer: apt
+`,
+			wantErr: anyError,
+		},
+		{
+			name: "BuildPreferBaseScalar",
+			body: `
+build_prefer:
+  ubuntu: apt
+`,
+			wantErr: anyError,
+		},
+		{
+			name: "BuildPreferNested",
+			body: `
+build_prefer:
+  ubuntu:
+    - [apt]
+`,
+			wantErr: anyError,
+		},
 		{
 			name: "Empty",
 			body: `
@@ -103,9 +406,167 @@ curl:
 				return
 			}
 
-			if !cmp.Equal(*res, tc.want) {
-				t.Error(cmp.Diff(*res, tc.want))
+			// Positions are covered by TestParsePositions.
+			ignorePos := cmpopts.IgnoreFields(Recipe{}, "Source")
+			ignoreListPos := cmpopts.IgnoreFields(PackageList{}, "Source")
+			ignoreInstallerPos := cmpopts.IgnoreFields(Installer{}, "Source", "DependencySources")
+			if !cmp.Equal(*res, tc.want, ignorePos, ignoreInstallerPos, ignoreListPos) {
+				t.Error(cmp.Diff(*res, tc.want, ignorePos, ignoreInstallerPos, ignoreListPos))
 			}
 		})
 	}
 }
+
+func TestParsePositions(t *testing.T) {
+	t.Parallel()
+
+	res, err := Parse(strings.NewReader(`wget:
+  check: "wget -h"
+  install_apt:
+    script: "apt install wget"
+    deps:
+      - apt
+`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	r := res.Recipes[0]
+	if r.Source != (Pos{Line: 1, Col: 1}) {
+		t.Errorf("recipe at %v, want 1:1", r.Source)
+	}
+	if r.Installers[0].Source != (Pos{Line: 3, Col: 3}) {
+		t.Errorf("installer at %v, want 3:3", r.Installers[0].Source)
+	}
+	if !cmp.Equal(r.Installers[0].DependencySources, []Pos{{Line: 6, Col: 9}}) {
+		t.Errorf("dependencies at %v, want [6:9]", r.Installers[0].DependencySources)
+	}
+
+	for _, tc := range []struct {
+		body string
+		want string
+	}{
+		{
+			body: "htop:\n  install_apt:\n    script: [apt, install]\n",
+			want: `3:13: parsing htop failed: expected "script" to be "string"`,
+		},
+		{
+			body: "htop:\n  install: apt-get install htop\n  check: htop -h\n  dog: dog\n",
+			want: `4:3: parsing htop failed: unexpected directive "dog"`,
+		},
+		{
+			body: "htop:\n  local_only: yes please\n",
+			want: `2:15: parsing htop failed: expected "local_only" to be "bool"`,
+		},
+	} {
+		_, err := Parse(strings.NewReader(tc.body))
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("got error %v, want %v", err, tc.want)
+		}
+	}
+}
+
+func TestTraversePositions(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "nfy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "nfy.yml"), []byte("import:\n  - tools.yml\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := filepath.Join(dir, "tools.yml")
+	err = ioutil.WriteFile(tools, []byte("wget:\n  install: apt-get install -y wget\njq:\n  check: 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res Result
+	err = Traverse(&res, filepath.Join(dir, "nfy.yml"))
+	want := tools + `:4:10: parsing jq failed: expected "check" to be "string"`
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+}
+
+func TestTraverseImports(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "nfy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = os.Mkdir(filepath.Join(dir, "lib"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{
+		"nfy.yml":   "import:\n  - lib/*.yml\n  - lib/../lib/a.yml\nvars:\n  CHANNEL: stable\n",
+		"lib/a.yml": "a:\n  check: \"true\"\n",
+		"lib/b.yml": "import:\n  - a.yml\nvars:\n  CHANNEL: beta\n  MIRROR: m\nb:\n  check: \"true\"\n",
+		"x.yml":     "import:\n  - y.yml\n",
+		"y.yml":     "import:\n  - x.yml\n",
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Duplicates", func(t *testing.T) {
+		var res Result
+		err := Traverse(&res, filepath.Join(dir, "nfy.yml"))
+		if err != nil {
+			t.Fatalf("traverse: %v", err)
+		}
+		var names []string
+		for _, r := range res.Recipes {
+			names = append(names, r.Name)
+		}
+		if !cmp.Equal(names, []string{"a", "b"}) {
+			t.Errorf("got recipes %v, want each file parsed once", names)
+		}
+		wantVars := map[string]string{"CHANNEL": "stable", "MIRROR": "m"}
+		if !cmp.Equal(res.Vars, wantVars) {
+			t.Errorf("unexpected vars: %v", cmp.Diff(wantVars, res.Vars))
+		}
+	})
+
+	t.Run("Cycle", func(t *testing.T) {
+		var res Result
+		x, y := filepath.Join(dir, "x.yml"), filepath.Join(dir, "y.yml")
+		err := Traverse(&res, x)
+		want := y + ":2:5: import cycle: " + x + " -> " + y + " -> " + x
+		if err == nil || err.Error() != want {
+			t.Errorf("got error %v, want %v", err, want)
+		}
+	})
+}
+
+func TestParseInstance(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		template string
+		args     []string
+		ok       bool
+	}{
+		{name: "apt-pkg(htop)", template: "apt-pkg", args: []string{"htop"}, ok: true},
+		{name: "apt-pkg(htop, 3.2)", template: "apt-pkg", args: []string{"htop", "3.2"}, ok: true},
+		{name: "htop"},
+		{name: "(htop)"},
+		{name: "apt-pkg(htop"},
+	} {
+		template, args, ok := ParseInstance(tc.name)
+		if template != tc.template || !cmp.Equal(args, tc.args) || ok != tc.ok {
+			t.Errorf("ParseInstance(%q) = %q, %q, %v", tc.name, template, args, ok)
+		}
+		if ok && InstanceName(template, args) != tc.name {
+			t.Errorf("InstanceName(%q, %q) = %q", template, args, InstanceName(template, args))
+		}
+	}
+}
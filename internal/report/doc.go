@@ -0,0 +1,2 @@
+// Package report records the outcome of each target so it can be rendered for CI systems.
+package report
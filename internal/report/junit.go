@@ -0,0 +1,148 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Status is the outcome of a target.
+type Status int
+
+const (
+	Passed Status = iota
+	Failed
+	Skipped
+)
+
+// Case is the result of evaluating a single target.
+type Case struct {
+	Target    string
+	Installer string
+	Status    Status
+	// Message explains a failure or skip.
+	Message  string
+	Output   string
+	Duration time.Duration
+}
+
+// Recorder collects Cases. It is safe for concurrent use.
+type Recorder struct {
+	start time.Time
+
+	mu    sync.Mutex
+	cases []Case
+}
+
+// NewRecorder returns a Recorder whose run starts now.
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// Add records c.
+func (r *Recorder) Add(c Case) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cases = append(r.cases, c)
+}
+
+// Failed returns the number of failed cases.
+func (r *Recorder) Failed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int
+	for _, c := range r.cases {
+		if c.Status == Failed {
+			n++
+		}
+	}
+	return n
+}
+
+// Cases returns the cases recorded so far, in order.
+func (r *Recorder) Cases() []Case {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Case(nil), r.cases...)
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Skipped   *junitMessage `xml:"skipped"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit renders the recorded cases as a JUnit XML test suite.
+func (r *Recorder) WriteJUnit(w io.Writer, suite string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := junitSuite{
+		Name:      suite,
+		Tests:     len(r.cases),
+		Time:      seconds(time.Since(r.start)),
+		Timestamp: r.start.Format("2006-01-02T15:04:05"),
+	}
+	for _, c := range r.cases {
+		name := c.Target
+		if c.Installer != "" {
+			name += " [" + c.Installer + "]"
+		}
+		jc := junitCase{
+			Name:      name,
+			Classname: suite,
+			Time:      seconds(c.Duration),
+			SystemOut: c.Output,
+		}
+		switch c.Status {
+		case Failed:
+			s.Failures++
+			jc.Failure = &junitMessage{Message: c.Message}
+		case Skipped:
+			s.Skipped++
+			jc.Skipped = &junitMessage{Message: c.Message}
+		}
+		s.Cases = append(s.Cases, jc)
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(junitSuites{Suites: []junitSuite{s}})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
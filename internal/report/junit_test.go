@@ -0,0 +1,48 @@
+package report
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteJUnit(t *testing.T) {
+	t.Parallel()
+
+	r := NewRecorder()
+	r.Add(Case{Target: "wget", Status: Passed, Duration: time.Second})
+	r.Add(Case{Target: "htop", Installer: "apt", Status: Failed, Message: "install failed: exit status 1", Output: "E: Unable to locate package"})
+	r.Add(Case{Target: "apt-update", Status: Skipped, Message: "build_only"})
+
+	var buf strings.Builder
+	err := r.WriteJUnit(&buf, "nfy")
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var got junitSuites
+	err = xml.Unmarshal([]byte(buf.String()), &got)
+	if err != nil {
+		t.Fatalf("unmarshal %s: %v", buf.String(), err)
+	}
+	if len(got.Suites) != 1 {
+		t.Fatalf("got %v suites, want 1", len(got.Suites))
+	}
+	s := got.Suites[0]
+	if s.Tests != 3 || s.Failures != 1 || s.Skipped != 1 {
+		t.Errorf("got tests=%v failures=%v skipped=%v", s.Tests, s.Failures, s.Skipped)
+	}
+	if c := s.Cases[0]; c.Name != "wget" || c.Time != "1.000" || c.Failure != nil || c.Skipped != nil {
+		t.Errorf("unexpected passing case %+v", c)
+	}
+	if c := s.Cases[1]; c.Name != "htop [apt]" || c.Failure == nil || c.SystemOut != "E: Unable to locate package" {
+		t.Errorf("unexpected failing case %+v", c)
+	}
+	if c := s.Cases[2]; c.Skipped == nil || c.Skipped.Message != "build_only" {
+		t.Errorf("unexpected skipped case %+v", c)
+	}
+	if r.Failed() != 1 {
+		t.Errorf("got %v failed, want 1", r.Failed())
+	}
+}
@@ -0,0 +1,139 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Executor runs scripts on the system being configured.
+type Executor interface {
+	// Run runs script with sh, writing its output to out.
+	Run(ctx context.Context, script string, out Output) error
+	// String describes the system for logs.
+	String() string
+}
+
+func runCommand(cmd *exec.Cmd, out Output) error {
+	cmd.Stderr = out.Stderr
+	cmd.Stdout = out.Stdout
+	return cmd.Run()
+}
+
+// Local runs scripts on the machine running nfy.
+type Local struct{}
+
+func (Local) Run(ctx context.Context, script string, out Output) error {
+	return runCommand(exec.CommandContext(ctx, defaultShell(), "-c", script), out)
+}
+
+func (Local) String() string {
+	return "localhost"
+}
+
+// DockerExec runs scripts in a running container with docker exec.
+type DockerExec struct {
+	Container string
+}
+
+func (d DockerExec) Run(ctx context.Context, script string, out Output) error {
+	return runCommand(exec.CommandContext(ctx, "docker", "exec", d.Container, defaultShell(), "-c", script), out)
+}
+
+func (d DockerExec) String() string {
+	return "container " + d.Container
+}
+
+// SSH runs scripts on a remote host with the ssh client, so that it's configured by ~/.ssh/config as usual.
+// Host is anything ssh accepts as a destination, such as user@box.
+type SSH struct {
+	Host string
+	// Command is the ssh client to run, "ssh" if empty.
+	Command string
+	// Args are passed to the client ahead of the destination.
+	Args []string
+}
+
+// shellQuote quotes s as a single shell word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func (s SSH) Run(ctx context.Context, script string, out Output) error {
+	command := s.Command
+	if command == "" {
+		command = "ssh"
+	}
+	// BatchMode fails instead of prompting, since there's nobody to answer.
+	args := append([]string{"-o", "BatchMode=yes"}, s.Args...)
+	// The remote shell parses the command, so the script is quoted for it.
+	args = append(args, "--", s.Host, defaultShell()+" -c "+shellQuote(script))
+	return runCommand(exec.CommandContext(ctx, command, args...), out)
+}
+
+func (s SSH) String() string {
+	return s.Host
+}
+
+// envExecutor exports variables ahead of each script.
+type envExecutor struct {
+	Executor
+	exports string
+}
+
+// WithEnv returns an Executor that runs scripts with the variables of env exported.
+func WithEnv(e Executor, env map[string]string) Executor {
+	if len(env) == 0 {
+		return e
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var exports strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&exports, "export %s=%s\n", name, shellQuote(env[name]))
+	}
+	return envExecutor{Executor: e, exports: exports.String()}
+}
+
+func (e envExecutor) Run(ctx context.Context, script string, out Output) error {
+	return e.Executor.Run(ctx, e.exports+script, out)
+}
+
+// Fake is an Executor that records the scripts it's given instead of running them.
+// It's safe for concurrent use.
+type Fake struct {
+	// Fail lists the scripts that exit with an error.
+	Fail map[string]bool
+
+	mu  sync.Mutex
+	ran []string
+}
+
+func (f *Fake) Run(_ context.Context, script string, out Output) error {
+	f.mu.Lock()
+	f.ran = append(f.ran, script)
+	f.mu.Unlock()
+	if f.Fail[script] {
+		fmt.Fprintf(out.Stderr, "%s: failed\n", script)
+		return fmt.Errorf("exit status 1")
+	}
+	return nil
+}
+
+func (f *Fake) String() string {
+	return "fake"
+}
+
+// Ran returns the scripts run so far, in order.
+func (f *Fake) Ran() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.ran...)
+}
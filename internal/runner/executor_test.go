@@ -0,0 +1,62 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSSH stands in for the ssh client. It drops the options and destination,
+// then has a shell parse the command the way sshd would.
+const fakeSSH = `#!/bin/sh
+while [ "$1" != "--" ]; do shift; done
+shift 2
+exec sh -c "$1"
+`
+
+func TestExecutors(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "nfy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ssh := filepath.Join(dir, "ssh")
+	err = ioutil.WriteFile(ssh, []byte(fakeSSH), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		ex   Executor
+		want string
+	}{
+		{Local{}, "it's\n"},
+		{SSH{Host: "user@box", Command: ssh, Args: []string{"-p", "2222"}}, "it's\n"},
+		{WithEnv(SSH{Host: "env@box", Command: ssh}, map[string]string{"GREETING": "'hi' $there"}), "'hi' $there\n"},
+	} {
+		ex, want := tc.ex, tc.want
+		t.Run(ex.String(), func(t *testing.T) {
+			t.Parallel()
+
+			var stdout, stderr bytes.Buffer
+			out := Output{Stdout: &stdout, Stderr: &stderr}
+			err := ex.Run(context.Background(), `echo "${GREETING:-it's}"; echo '$HOME' >&2`, out)
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if stdout.String() != want || stderr.String() != "$HOME\n" {
+				t.Errorf("got stdout %q, stderr %q", stdout.String(), stderr.String())
+			}
+
+			err = ex.Run(context.Background(), "exit 3", out)
+			if err == nil {
+				t.Errorf("expected failing script to return an error")
+			}
+		})
+	}
+}
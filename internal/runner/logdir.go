@@ -0,0 +1,125 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogDir keeps the output of every script invocation in its own file.
+// An index of the invocations is written by WriteIndex.
+type LogDir struct {
+	path  string
+	start time.Time
+
+	mu      sync.Mutex
+	entries []*LogEntry
+}
+
+// LogEntry describes a single script invocation in the index.
+type LogEntry struct {
+	Target    string        `json:"target"`
+	Installer string        `json:"installer,omitempty"`
+	Phase     string        `json:"phase"`
+	File      string        `json:"file"`
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration_ns"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// OpenLogDir creates the log directory if it doesn't exist.
+func OpenLogDir(path string) (*LogDir, error) {
+	err := os.MkdirAll(path, 0750)
+	if err != nil {
+		return nil, fmt.Errorf("create log dir: %w", err)
+	}
+	return &LogDir{
+		path:  path,
+		start: time.Now(),
+	}, nil
+}
+
+// logFileName produces <target>[<installer>].<phase>.log.
+func logFileName(i Installer, phase string) string {
+	name := i.FullName()
+	if i.Name != "" {
+		name += "[" + i.Name + "]"
+	}
+	name = strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(name)
+	return name + "." + phase + ".log"
+}
+
+// Log is the log file of a single script invocation.
+type Log struct {
+	dir   *LogDir
+	f     *os.File
+	entry *LogEntry
+}
+
+// Open creates the log file for a phase (e.g "check" or "install") of an installer.
+func (d *LogDir) Open(i Installer, phase string) (*Log, error) {
+	name := logFileName(i, phase)
+	f, err := os.Create(filepath.Join(d.path, name))
+	if err != nil {
+		return nil, fmt.Errorf("create log: %w", err)
+	}
+	entry := &LogEntry{
+		Target:    i.FullName(),
+		Installer: i.Name,
+		Phase:     phase,
+		File:      name,
+		Start:     time.Now(),
+	}
+
+	d.mu.Lock()
+	d.entries = append(d.entries, entry)
+	d.mu.Unlock()
+	return &Log{dir: d, f: f, entry: entry}, nil
+}
+
+func (l *Log) Write(p []byte) (int, error) {
+	return l.f.Write(p)
+}
+
+// Close records the result of the invocation and closes the file.
+func (l *Log) Close(result error) error {
+	l.dir.mu.Lock()
+	l.entry.Duration = time.Since(l.entry.Start)
+	if result != nil {
+		l.entry.Error = result.Error()
+	}
+	l.dir.mu.Unlock()
+	return l.f.Close()
+}
+
+// WriteIndex writes index.json, which lists every invocation logged so far.
+func (d *LogDir) WriteIndex() error {
+	d.mu.Lock()
+	index := struct {
+		Start   time.Time   `json:"start"`
+		Entries []*LogEntry `json:"entries"`
+	}{
+		Start:   d.start,
+		Entries: d.entries,
+	}
+	b, err := json.MarshalIndent(index, "", "  ")
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(d.path, "index.json"), b, 0640)
+}
+
+// Tee returns an Output that also writes both streams to w.
+func (o Output) Tee(w io.Writer) Output {
+	return Output{
+		Stdout: io.MultiWriter(o.Stdout, w),
+		Stderr: io.MultiWriter(o.Stderr, w),
+	}
+}
@@ -0,0 +1,116 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"cdr.dev/nfy/internal/parse"
+)
+
+func TestLogDir(t *testing.T) {
+	t.Parallel()
+
+	tmp, err := ioutil.TempDir("", "nfy-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "run", "logs")
+	logs, err := OpenLogDir(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	wget := Installer{Recipe: parse.Recipe{Name: "wget"}}
+	htop := Installer{
+		Recipe:    parse.Recipe{Name: "htop"},
+		Repo:      "github.com/ammario/dotfiles",
+		Installer: parse.Installer{Name: "apt"},
+	}
+	for _, tc := range []struct {
+		installer Installer
+		phase     string
+		script    string
+	}{
+		{wget, "check", "echo missing >&2; exit 1"},
+		{htop, "install", "echo installing htop"},
+	} {
+		log, err := logs.Open(tc.installer, tc.phase)
+		if err != nil {
+			t.Fatalf("open log: %v", err)
+		}
+		out := Output{Stdout: ioutil.Discard, Stderr: ioutil.Discard}.Tee(log)
+		err = Local{}.Run(context.Background(), tc.script, out)
+		err = log.Close(err)
+		if err != nil {
+			t.Fatalf("close log: %v", err)
+		}
+	}
+	err = logs.WriteIndex()
+	if err != nil {
+		t.Fatalf("write index: %v", err)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, info := range infos {
+		if info.Name() == "index.json" {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[info.Name()] = string(b)
+	}
+	// Stderr is logged too, and remote names can't create directories.
+	wantFiles := map[string]string{
+		"wget.check.log": "missing\n",
+		"github.com_ammario_dotfiles:htop[apt].install.log": "installing htop\n",
+	}
+	if !cmp.Equal(files, wantFiles) {
+		t.Errorf("unexpected log files: %v", cmp.Diff(wantFiles, files))
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index struct {
+		Entries []LogEntry `json:"entries"`
+	}
+	err = json.Unmarshal(b, &index)
+	if err != nil {
+		t.Fatalf("unmarshal index: %v", err)
+	}
+	sort.Slice(index.Entries, func(i, j int) bool { return index.Entries[i].File < index.Entries[j].File })
+	var got []LogEntry
+	for _, e := range index.Entries {
+		if e.Start.IsZero() || e.Duration <= 0 {
+			t.Errorf("%v: missing timing in %+v", e.File, e)
+		}
+		got = append(got, LogEntry{Target: e.Target, Installer: e.Installer, Phase: e.Phase, File: e.File, Error: e.Error})
+	}
+	want := []LogEntry{
+		{
+			Target:    "github.com/ammario/dotfiles:htop",
+			Installer: "apt",
+			Phase:     "install",
+			File:      "github.com_ammario_dotfiles:htop[apt].install.log",
+		},
+		{Target: "wget", Phase: "check", File: "wget.check.log", Error: "exit status 1"},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("unexpected index: %v", cmp.Diff(want, got))
+	}
+}
@@ -0,0 +1,95 @@
+package runner
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// LineWriter buffers writes and forwards them to an underlying writer one complete line at a time,
+// each line preceded by a prefix.
+// LineWriters that share a mutex never interleave their lines mid-line.
+type LineWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+
+	// buf holds the incomplete trailing line.
+	// It is only accessed by the owner of the LineWriter, not under mu.
+	buf []byte
+}
+
+// NewLineWriter returns a LineWriter that writes prefixed lines to w while holding mu.
+func NewLineWriter(w io.Writer, mu *sync.Mutex, prefix string) *LineWriter {
+	return &LineWriter{
+		mu:     mu,
+		w:      w,
+		prefix: prefix,
+	}
+}
+
+func (l *LineWriter) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	i := bytes.LastIndexByte(l.buf, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	err := l.writeLines(l.buf[:i+1])
+	l.buf = append(l.buf[:0], l.buf[i+1:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes out any incomplete trailing line.
+func (l *LineWriter) Flush() error {
+	if len(l.buf) == 0 {
+		return nil
+	}
+	err := l.writeLines(append(l.buf, '\n'))
+	l.buf = l.buf[:0]
+	return err
+}
+
+// writeLines prefixes each newline terminated line in p and writes them out in a single call.
+func (l *LineWriter) writeLines(p []byte) error {
+	var out bytes.Buffer
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		out.WriteString(l.prefix)
+		out.Write(p[:i+1])
+		p = p[i+1:]
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(out.Bytes())
+	return err
+}
+
+// StreamOutput returns an Output that writes prefixed lines to stdout and stderr.
+// All Outputs created with the same mutex may be written to concurrently.
+func StreamOutput(stdout, stderr io.Writer, mu *sync.Mutex, prefix string) Output {
+	return Output{
+		Stdout: NewLineWriter(stdout, mu, prefix),
+		Stderr: NewLineWriter(stderr, mu, prefix),
+	}
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// Flush flushes any buffered output.
+func (o Output) Flush() error {
+	for _, w := range []io.Writer{o.Stdout, o.Stderr} {
+		if f, ok := w.(flusher); ok {
+			err := f.Flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("PartialLines", func(t *testing.T) {
+		var (
+			buf bytes.Buffer
+			mu  sync.Mutex
+		)
+		w := NewLineWriter(&buf, &mu, "wget | ")
+		fmt.Fprint(w, "hello ")
+		if buf.Len() != 0 {
+			t.Fatalf("incomplete line was written: %q", buf.String())
+		}
+		fmt.Fprint(w, "world\nsecond\nthi")
+		fmt.Fprint(w, "rd")
+		err := w.Flush()
+		if err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+
+		const want = "wget | hello world\nwget | second\nwget | third\n"
+		if buf.String() != want {
+			t.Errorf("got %q, want %q", buf.String(), want)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		var (
+			buf bytes.Buffer
+			mu  sync.Mutex
+			wg  sync.WaitGroup
+		)
+		const lines = 200
+		for _, prefix := range []string{"a", "b", "c", "d"} {
+			wg.Add(1)
+			go func(prefix string) {
+				defer wg.Done()
+				w := NewLineWriter(&buf, &mu, prefix+" | ")
+				for i := 0; i < lines; i++ {
+					// Write each line in pieces to tempt interleaving.
+					fmt.Fprint(w, prefix)
+					fmt.Fprint(w, strings.Repeat(prefix, 10))
+					fmt.Fprint(w, "\n")
+				}
+				w.Flush()
+			}(prefix)
+		}
+		wg.Wait()
+
+		got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		if len(got) != lines*4 {
+			t.Fatalf("got %v lines, want %v", len(got), lines*4)
+		}
+		for _, line := range got {
+			prefix := line[:1]
+			if line != prefix+" | "+strings.Repeat(prefix, 11) {
+				t.Fatalf("interleaved line %q", line)
+			}
+		}
+	})
+}
@@ -1,10 +1,11 @@
 package runner
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"os/exec"
 
+	"cdr.dev/nfy/internal/packages"
 	"cdr.dev/nfy/internal/parse"
 )
 
@@ -12,6 +13,7 @@ func defaultShell() string {
 	return "sh"
 }
 
+// Output is where a script's output is written.
 type Output struct {
 	Stderr io.Writer
 	Stdout io.Writer
@@ -20,6 +22,11 @@ type Output struct {
 type Installer struct {
 	Recipe parse.Recipe
 	Repo string
+	// Revision is the repository and commit a remote recipe was loaded from, as <repo>@<commit>.
+	Revision string
+	// Skip explains why the recipe doesn't apply to the system, if it doesn't.
+	// Skipped installers do nothing, and count as satisfied for their dependents.
+	Skip string
 	parse.Installer
 }
 
@@ -36,7 +43,12 @@ func FromParseRecipes(rs []parse.Recipe, repo string) []Installer {
 	var is []Installer
 	for _, recipe := range rs {
 		for _, installer := range recipe.Installers {
-			is = append(is, Installer{recipe, repo, installer})
+			r := recipe
+			if m, ok := packages.Lookup(installer.Manager); ok {
+				// Each manager checks its own packages.
+				r.Check = m.Check(installer.Packages)
+			}
+			is = append(is, Installer{Recipe: r, Repo: repo, Installer: installer})
 		}
 		if len(recipe.Installers) == 0 && recipe.Check != "" {
 			// Add a check-only installer if none provided.
@@ -50,11 +62,9 @@ func FromParseRecipes(rs []parse.Recipe, repo string) []Installer {
 	return is
 }
 
-func (i Installer) Check(out Output) error {
-	cmd := exec.Command(defaultShell(), "-c", i.Recipe.Check)
-	cmd.Stderr = out.Stderr
-	cmd.Stdout = out.Stdout
-	return cmd.Run()
+// Check runs the recipe's check with e.
+func (i Installer) Check(ctx context.Context, e Executor, out Output) error {
+	return e.Run(ctx, i.Recipe.Check, out)
 }
 
 func (i Installer) CheckOnly() bool {
@@ -66,13 +76,10 @@ func (i Installer) DependencyOnly() bool {
 	return i.Recipe.Check == "" && len(i.Recipe.Installers) == 0
 }
 
-func (i Installer) Install(out Output) error {
+// Install runs the installer's script with e.
+func (i Installer) Install(ctx context.Context, e Executor, out Output) error {
 	if i.Script == "" {
 		return fmt.Errorf("no installer provided")
 	}
-
-	cmd := exec.Command(defaultShell(), "-c", i.Script)
-	cmd.Stderr = out.Stderr
-	cmd.Stdout = out.Stdout
-	return cmd.Run()
+	return e.Run(ctx, i.Script, out)
 }
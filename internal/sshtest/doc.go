@@ -0,0 +1,2 @@
+// Package sshtest provides a stand-in SSH server, for testing code that drives the ssh client.
+package sshtest
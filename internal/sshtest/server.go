@@ -0,0 +1,140 @@
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is an SSH server that runs the commands it's sent with sh on the local machine.
+// It accepts any client without authentication.
+type Server struct {
+	// Port is the port it listens on, on 127.0.0.1.
+	Port string
+
+	env      []string
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a Server that runs commands with env added to the environment.
+func NewServer(env ...string) (*Server, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	s := &Server{Port: port, env: env, listener: l, config: config}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Args returns the arguments that make the ssh client connect to the server, ahead of a destination on 127.0.0.1.
+// The server's host key changes every time, so it isn't checked.
+func (s *Server) Args() []string {
+	return []string{
+		"-F", "/dev/null",
+		"-p", s.Port,
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+	}
+}
+
+// Close stops accepting connections.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(ch, reqs)
+	}
+}
+
+// session runs the command of an exec request, ignoring any other request.
+func (s *Server) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		status := s.run(payload.Command, ch)
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+// run runs command the way sshd would, returning its exit status.
+func (s *Server) run(command string, ch ssh.Channel) uint32 {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), s.env...)
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+	err := cmd.Run()
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return uint32(exitErr.ExitCode())
+	}
+	return 255
+}